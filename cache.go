@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// cacheVersion is part of every fingerprint, bump it when cacheEntry gains fields so old entries are not used
+const cacheVersion = "3"
+
+// statusCache is set for runs that can reuse results from the last run
+var statusCache *repoCache
+
+// repoCache persists each repo's status between runs, keyed on the mtimes of the files git changes when the status does.
+// Changes in the working tree are not cached, as editing a file touches none of them.
+type repoCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	Fingerprint   string `json:"fingerprint"`
+	Branch        string `json:"branch"`
+	DefaultBranch string `json:"default_branch,omitempty"`
+	Operation     string `json:"operation,omitempty"`
+	Stashes       int    `json:"stashes"`
+	Ahead         int    `json:"ahead"`
+	Behind        int    `json:"behind"`
+	LastCommit    int64  `json:"last_commit"`
+	CommitHash    string `json:"commit_hash,omitempty"`
+	CommitAuthor  string `json:"commit_author,omitempty"`
+	CommitSubject string `json:"commit_subject,omitempty"`
+	Remote        string `json:"remote,omitempty"`
+}
+
+func cachePath() (string, error) {
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "gitstatus", "cache.json"), nil
+}
+
+// loadCache reads the cache file, starting empty if it is missing or unreadable
+func loadCache(path string) *repoCache {
+
+	c := &repoCache{path: path, entries: map[string]cacheEntry{}}
+
+	b, err := os.ReadFile(path)
+	if err == nil {
+		_ = json.Unmarshal(b, &c.entries)
+	}
+
+	return c
+}
+
+func (c *repoCache) save() error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(c.path, b, 0o644)
+}
+
+// get returns the cached row, without changes, if nothing git tracks has changed since it was stored
+func (c *repoCache) get(r repoItem) (rowItem, bool) {
+
+	fingerprint, err := cacheFingerprint(r.path)
+	if err != nil {
+		return rowItem{}, false
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[r.path]
+	c.mu.Unlock()
+
+	if !ok || entry.Fingerprint != fingerprint {
+		return rowItem{}, false
+	}
+
+	row := rowItem{
+		path:          r.path,
+		worktreeOf:    r.worktreeOf,
+		mainBranches:  mainBranches(r.path),
+		branch:        entry.Branch,
+		defaultBranch: entry.DefaultBranch,
+		operation:     entry.Operation,
+		stashes:       entry.Stashes,
+		ahead:         entry.Ahead,
+		behind:        entry.Behind,
+		lastCommit:    commitInfo{hash: entry.CommitHash, author: entry.CommitAuthor, subject: entry.CommitSubject},
+		lastFetch:     lastFetchTime(r.path), // Not covered by the fingerprint
+		remote:        entry.Remote,
+	}
+	if entry.LastCommit != 0 {
+		row.lastCommit.when = time.Unix(entry.LastCommit, 0)
+	}
+
+	return row, true
+}
+
+// put stores a row, errors are not cached so they are retried next time
+func (c *repoCache) put(row rowItem) {
+
+	if row.error != nil {
+		return
+	}
+
+	fingerprint, err := cacheFingerprint(row.path)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[row.path] = cacheEntry{
+		Fingerprint:   fingerprint,
+		Branch:        row.branch,
+		DefaultBranch: row.defaultBranch,
+		Operation:     row.operation,
+		Stashes:       row.stashes,
+		Ahead:         row.ahead,
+		Behind:        row.behind,
+		LastCommit:    row.lastCommit.when.Unix(),
+		CommitHash:    row.lastCommit.hash,
+		CommitAuthor:  row.lastCommit.author,
+		CommitSubject: row.lastCommit.subject,
+		Remote:        row.remote,
+	}
+}
+
+// cacheFingerprint combines the mtimes of the index, HEAD, the git dir (for merge/rebase state files) and all refs
+func cacheFingerprint(repoPath string) (string, error) {
+
+	gitDir := resolveGitDir(repoPath)
+	common := commonGitDir(gitDir)
+
+	parts := []string{cacheVersion}
+
+	for _, path := range []string{gitDir, filepath.Join(gitDir, "index"), filepath.Join(gitDir, "HEAD"), common, filepath.Join(common, "packed-refs")} {
+		info, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			parts = append(parts, "-")
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		parts = append(parts, strconv.FormatInt(info.ModTime().UnixNano(), 36)+"/"+strconv.FormatInt(info.Size(), 36))
+	}
+
+	// Any ref being created, moved or deleted
+	var latest int64
+	var count int
+	err := filepath.WalkDir(filepath.Join(common, "refs"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		latest = max(latest, info.ModTime().UnixNano())
+		count++
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	parts = append(parts, strconv.FormatInt(latest, 36)+"/"+strconv.Itoa(count))
+
+	// The default branch is only looked up when asked for
+	parts = append(parts, strconv.FormatBool(viper.GetBool(fDetectMain)))
+
+	return strings.Join(parts, ":"), nil
+}
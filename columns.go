@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+)
+
+// tableColumn is a column that can be picked with --columns
+type tableColumn struct {
+	header string
+	value  func(r rowItem, roots []string) any
+}
+
+var tableColumns = map[string]tableColumn{
+	"repo":        {"Repo", func(r rowItem, roots []string) any { return r.displayPath(roots) }},
+	"branch":      {"Branch", func(r rowItem, roots []string) any { return r.displayBranch() }},
+	"changes":     {"Changes", func(r rowItem, roots []string) any { return r.changedFiles }},
+	"staged":      {"Staged", func(r rowItem, roots []string) any { return blankZero(r.changes.staged) }},
+	"unstaged":    {"Unstaged", func(r rowItem, roots []string) any { return blankZero(r.changes.unstaged) }},
+	"untracked":   {"Untracked", func(r rowItem, roots []string) any { return blankZero(r.changes.untracked) }},
+	"renamed":     {"Renamed", func(r rowItem, roots []string) any { return blankZero(r.changes.renamed) }},
+	"conflicted":  {"Conflicted", func(r rowItem, roots []string) any { return blankZero(r.changes.conflicted) }},
+	"sync":        {"Sync", func(r rowItem, roots []string) any { return r.sync() }},
+	"ahead":       {"Ahead", func(r rowItem, roots []string) any { return blankZero(r.ahead) }},
+	"behind":      {"Behind", func(r rowItem, roots []string) any { return blankZero(r.behind) }},
+	"state":       {"State", func(r rowItem, roots []string) any { return r.state() }},
+	"fetch":       {"Fetch", func(r rowItem, roots []string) any { return r.fetch() }},
+	"pull":        {"Pull", func(r rowItem, roots []string) any { return r.pull() }},
+	"last-commit": {"Last Commit", func(r rowItem, roots []string) any { return r.lastCommitDate() }},
+	"commit":      {"Commit", func(r rowItem, roots []string) any { return r.lastCommit.hash }},
+	"age":         {"Age", func(r rowItem, roots []string) any { return r.lastCommitAge() }},
+	"author":      {"Author", func(r rowItem, roots []string) any { return r.lastCommit.author }},
+	"subject":     {"Subject", func(r rowItem, roots []string) any { return r.lastCommitSubject() }},
+	"remote":      {"Remote", func(r rowItem, roots []string) any { return r.remote }},
+	"error": {"Error", func(r rowItem, roots []string) any {
+		if r.error != nil {
+			return r.error.Error()
+		}
+		return ""
+	}},
+}
+
+// blankZero keeps count columns readable by leaving zeros empty
+func blankZero(n int) any {
+	if n == 0 {
+		return ""
+	}
+	return n
+}
+
+// tableColumnNames returns the columns picked with --columns, or the default set for these rows
+func tableColumnNames(rows []rowItem) []string {
+
+	if columns := splitList(viper.GetStringSlice(fColumns)); len(columns) > 0 {
+		return columns
+	}
+
+	var hasErrors, hasState bool
+	for _, v := range rows {
+		if v.error != nil {
+			hasErrors = true
+		}
+		if v.state() != "" {
+			hasState = true
+		}
+	}
+
+	columns := []string{"repo", "branch"}
+	if viper.GetBool(fDetailed) {
+		columns = append(columns, "staged", "unstaged", "untracked", "renamed", "conflicted")
+	} else {
+		columns = append(columns, "changes")
+	}
+	columns = append(columns, "sync")
+	if hasState {
+		columns = append(columns, "state")
+	}
+	if viper.GetBool(fFetch) {
+		columns = append(columns, "fetch")
+	}
+	if viper.GetBool(fPull) {
+		columns = append(columns, "pull")
+	}
+	if hasErrors {
+		columns = append(columns, "error")
+	}
+
+	return columns
+}
+
+// checkColumns returns an error for the first unknown --columns name
+func checkColumns() error {
+	for _, name := range splitList(viper.GetStringSlice(fColumns)) {
+		if _, ok := tableColumns[name]; !ok {
+			return fmt.Errorf("unknown column: %s", name)
+		}
+	}
+	return nil
+}
+
+// parseFormat parses a --format template, which is run against each row's rowView
+func parseFormat(format string) (*template.Template, error) {
+
+	// One line per repo, without needing a trailing {{"\n"}}
+	if !strings.HasSuffix(format, "\n") {
+		format += "\n"
+	}
+
+	return template.New("format").Parse(format)
+}
+
+// outputFormat prints each row through a template, for scripting
+func outputFormat(rows []rowItem, roots []string, tmpl *template.Template) {
+
+	sortRows(rows)
+
+	for _, row := range rows {
+
+		if !row.show() {
+			continue
+		}
+
+		if viper.GetBool(fShort) {
+			row.path = trimRoot(row.path, roots)
+		}
+
+		if err := tmpl.Execute(os.Stdout, row.view()); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}
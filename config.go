@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/viper"
+)
+
+// configPath returns the config file to read, and whether it was asked for explicitly
+func configPath() (string, bool) {
+
+	if path := viper.GetString(fConfig); path != "" {
+		return expandHome(path), true
+	}
+
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", false
+		}
+		dir = filepath.Join(home, ".config")
+	}
+
+	return filepath.Join(dir, "gitstatus", "config.yaml"), false
+}
+
+// loadConfig reads the config file and applies the selected profile on top of it.
+// Flags and env vars still take precedence over anything in the file.
+func loadConfig() error {
+
+	path, explicit := configPath()
+	if path != "" {
+		if _, err := os.Stat(path); err == nil || explicit {
+			viper.SetConfigFile(path)
+			if err := viper.ReadInConfig(); err != nil {
+				return err
+			}
+		}
+	}
+
+	profile := viper.GetString(fProfile)
+	if profile == "" {
+		return nil
+	}
+
+	settings := viper.GetStringMap("profiles." + profile)
+	if len(settings) == 0 {
+		return errors.New("profile not found: " + profile)
+	}
+
+	return viper.MergeConfigMap(settings)
+}
+
+var defaultMainBranches = []string{"master", "main", "trunk", "develop", "dev"}
+
+// repoConfig holds settings for a single repo, from the repos list in the config file
+type repoConfig struct {
+	Path         string   `mapstructure:"path"`
+	MainBranches []string `mapstructure:"main-branches"`
+}
+
+// mainBranches returns the branch names that count as main for a repo
+func mainBranches(repoPath string) []string {
+
+	var repos []repoConfig
+	if err := viper.UnmarshalKey("repos", &repos); err == nil {
+		for _, rc := range repos {
+			if filepath.Clean(expandHome(rc.Path)) == filepath.Clean(repoPath) && len(rc.MainBranches) > 0 {
+				return splitList(rc.MainBranches)
+			}
+		}
+	}
+
+	if branches := splitList(viper.GetStringSlice(fMainBranches)); len(branches) > 0 {
+		return branches
+	}
+
+	return defaultMainBranches
+}
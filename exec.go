@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var execCmd = &cobra.Command{
+	Use:   "exec -- <command> [args...]",
+	Short: "Run a command in every matched repo",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if err := loadConfig(); err != nil {
+			log.Println("unable to load config: " + err.Error())
+			exitCode = exitFailed
+			return
+		}
+
+		repos, roots, ok := findRepos()
+		if !ok {
+			exitCode = exitFailed
+			return
+		}
+
+		results := execRepos(repos, args)
+
+		outputExecTable(results, roots)
+
+		exitCode = execExitCode(results)
+	},
+}
+
+type execItem struct {
+	path     string
+	exitCode int
+	stdout   []byte
+	stderr   []byte
+	error    error // The command could not be run at all
+}
+
+func (e execItem) failed() bool {
+	return e.error != nil || e.exitCode != 0
+}
+
+// execExitCode lets scripts see when the command failed in any repo
+func execExitCode(results []execItem) int {
+	for _, result := range results {
+		if result.failed() {
+			return exitErrored
+		}
+	}
+	return exitClean
+}
+
+func execRepos(repos []repoItem, args []string) (results []execItem) {
+
+	var mu sync.Mutex
+
+	forEachRepo(repos, func(r repoItem) {
+		result := execRepo(r.path, args)
+		mu.Lock()
+		results = append(results, result)
+		mu.Unlock()
+	})
+
+	return results
+}
+
+// execRepo runs a command inside a repo, capturing its output
+func execRepo(repoPath string, args []string) execItem {
+
+	result := execItem{path: repoPath}
+
+	var stdout, stderr bytes.Buffer
+
+	c := exec.Command(args[0], args[1:]...)
+	c.Dir = repoPath
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+
+	err := c.Run()
+
+	result.stdout = stdout.Bytes()
+	result.stderr = stderr.Bytes()
+
+	var exitError *exec.ExitError
+	if errors.As(err, &exitError) {
+		result.exitCode = exitError.ExitCode()
+	} else if err != nil {
+		result.error = err
+	}
+
+	return result
+}
+
+func outputExecTable(results []execItem, roots []string) {
+
+	sort.Slice(results, func(i, j int) bool {
+		return strings.ToLower(results[i].path) < strings.ToLower(results[j].path)
+	})
+
+	tab := table.NewWriter()
+	tab.SetOutputMirror(os.Stdout)
+	tab.AppendHeader(table.Row{"Repo", "Exit", "Output"})
+	tab.SetStyle(table.StyleRounded)
+
+	var failed int
+
+	for _, result := range results {
+
+		path := result.path
+		if viper.GetBool(fShort) {
+			path = trimRoot(path, roots)
+		}
+
+		// Show the last line of successful runs, and everything from failures
+		if !result.failed() {
+			tab.AppendRow(table.Row{path, color.GreenString("0"), string(lastLine(result.stdout))})
+			continue
+		}
+
+		failed++
+
+		output := strings.TrimSpace(string(result.stdout) + "\n" + string(result.stderr))
+		exitCode := strconv.Itoa(result.exitCode)
+		if result.error != nil {
+			output = result.error.Error()
+			exitCode = "-"
+		}
+
+		tab.AppendRow(table.Row{color.RedString(path), color.RedString(exitCode), output})
+	}
+
+	tab.Render()
+
+	if failed > 0 {
+		log.Println(color.RedString("%d of %d repos failed", failed, len(results)))
+	}
+}
@@ -4,57 +4,124 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"net/url"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
-
-	"github.com/fatih/color"
 )
 
-// gitDiff returns a colored summary of new/changed/deleted files
-func gitDiff(repoPath string) (string, error) {
+// gitBackend runs git commands, so tests can swap in a scripted fake
+type gitBackend interface {
+	run(ctx context.Context, repoPath string, args ...string) (stdout []byte, stderr []byte, err error)
+}
+
+var backend gitBackend = execBackend{}
+
+// gitError is returned by a backend when git exits with a non-zero code
+type gitError struct {
+	exitCode int
+	stderr   string
+}
+
+func (e *gitError) Error() string {
+	if e.stderr != "" {
+		return e.stderr
+	}
+	return "git exited with code " + strconv.Itoa(e.exitCode)
+}
+
+// execBackend shells out to the git binary
+type execBackend struct{}
+
+func (execBackend) run(ctx context.Context, repoPath string, args ...string) ([]byte, []byte, error) {
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", repoPath}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_OPTIONAL_LOCKS=0") // Stop `git status` rewriting the index, which watch mode would see as a change
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return stdout.Bytes(), stderr.Bytes(), ctx.Err()
+	}
+
+	var exitError *exec.ExitError
+	if errors.As(err, &exitError) {
+		return stdout.Bytes(), stderr.Bytes(), &gitError{exitCode: exitError.ExitCode(), stderr: string(bytes.TrimSpace(stderr.Bytes()))}
+	}
+
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// gitDiff returns counts of changed files, from `git status --porcelain=v2`
+func gitDiff(repoPath string) (diffCounts, error) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	b, err := exec.CommandContext(ctx, "git", "-C", repoPath, "status", "--porcelain").Output()
+	b, _, err := backend.run(ctx, repoPath, "status", "--porcelain=v2")
 	if err != nil {
-		return "", err
+		return diffCounts{}, err
 	}
 
-	b = bytes.TrimSpace(b)
-	if len(b) == 0 {
-		return "", nil
-	}
+	return parsePorcelainV2(b), nil
+}
+
+// parsePorcelainV2 counts entries by line type, and by the XY staged/unstaged status where there is one.
+// https://git-scm.com/docs/git-status#_porcelain_format_version_2
+func parsePorcelainV2(b []byte) (d diffCounts) {
+
+	for _, line := range bytes.Split(bytes.TrimSpace(b), []byte("\n")) {
 
-	var added, modified, deleted int
-	for _, line := range bytes.Split(b, []byte("\n")) {
 		if len(line) < 2 {
 			continue
 		}
-		status := string(line[:2])
-		switch {
-		case status == "??", strings.ContainsAny(status, "A"):
-			added++
-		case strings.ContainsAny(status, "D"):
-			deleted++
+
+		switch line[0] {
+		case '?':
+			d.untracked++ // Not an addition until it is staged
+			continue
+		case 'u':
+			// Unmerged entries are only counted as conflicts, their XY is not a staged/unstaged status
+			d.conflicted++
+			continue
+		case '1', '2':
+			if len(line) < 4 {
+				continue
+			}
 		default:
-			modified++
+			continue // Headers and ignored files
 		}
-	}
 
-	var parts []string
-	if added > 0 {
-		parts = append(parts, color.GreenString("+%d", added))
-	}
-	if modified > 0 {
-		parts = append(parts, color.RGB(255, 165, 0).Sprintf("~%d", modified))
-	}
-	if deleted > 0 {
-		parts = append(parts, color.RedString("-%d", deleted))
+		x, y := line[2], line[3]
+
+		if x != '.' {
+			d.staged++
+		}
+		if y != '.' {
+			d.unstaged++
+		}
+
+		if line[0] == '2' {
+			d.renamed++
+		}
+
+		switch {
+		case x == 'A' || y == 'A':
+			d.added++
+		case x == 'D' || y == 'D':
+			d.deleted++
+		default:
+			d.modified++
+		}
 	}
 
-	return strings.Join(parts, " "), nil
+	return d
 }
 
 // gitBranch gets the branch name
@@ -63,7 +130,7 @@ func gitBranch(pathx string) (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	b, err := exec.CommandContext(ctx, "git", "-C", pathx, "branch", "--show-current").Output()
+	b, _, err := backend.run(ctx, pathx, "branch", "--show-current")
 	if err != nil {
 		return "", err
 	}
@@ -74,21 +141,278 @@ func gitBranch(pathx string) (string, error) {
 	}
 
 	// Fallback for detached HEAD
-	b, _ = exec.CommandContext(ctx, "git", "-C", pathx, "rev-parse", "HEAD").Output()
+	b, _, _ = backend.run(ctx, pathx, "rev-parse", "HEAD")
+	return string(bytes.TrimSpace(b)), nil
+}
+
+// gitDefaultBranch returns the remote's default branch from origin/HEAD, or empty if it is not set
+func gitDefaultBranch(repoPath string) (string, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	b, _, err := backend.run(ctx, repoPath, "symbolic-ref", "-q", "--short", "refs/remotes/origin/HEAD")
+
+	var gitErr *gitError
+	if errors.As(err, &gitErr) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return strings.TrimPrefix(string(bytes.TrimSpace(b)), "origin/"), nil
+}
+
+// gitAheadBehind returns how many commits HEAD is ahead of and behind its upstream
+func gitAheadBehind(repoPath string) (ahead int, behind int, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// No upstream configured (or detached HEAD), nothing to compare against
+	if _, _, err := backend.run(ctx, repoPath, "rev-parse", "--abbrev-ref", "@{upstream}"); err != nil {
+		return 0, 0, nil
+	}
+
+	b, _, err := backend.run(ctx, repoPath, "rev-list", "--left-right", "--count", "HEAD...@{upstream}")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 {
+		return 0, 0, errors.New("unexpected rev-list output: " + string(b))
+	}
+
+	ahead, err = strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	behind, err = strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return ahead, behind, nil
+}
+
+// commitInfo describes a single commit
+type commitInfo struct {
+	hash    string // Abbreviated
+	when    time.Time
+	author  string
+	subject string
+}
+
+// gitLastCommit returns the commit at HEAD, or an empty commit if there are no commits yet
+func gitLastCommit(repoPath string) (commitInfo, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	b, _, err := backend.run(ctx, repoPath, "log", "-1", "--format=%h%x00%ct%x00%an%x00%s")
+
+	var gitErr *gitError
+	if errors.As(err, &gitErr) {
+		return commitInfo{}, nil
+	} else if err != nil {
+		return commitInfo{}, err
+	}
+
+	fields := strings.Split(strings.TrimSpace(string(b)), "\x00")
+	if len(fields) != 4 {
+		return commitInfo{}, errors.New("unexpected log output: " + string(b))
+	}
+
+	secs, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return commitInfo{}, errors.New("unexpected log output: " + string(b))
+	}
+
+	return commitInfo{hash: fields[0], when: time.Unix(secs, 0), author: fields[2], subject: fields[3]}, nil
+}
+
+// lastFetchTime returns when the repo was last fetched, from FETCH_HEAD, or the zero time if it never has been
+func lastFetchTime(repoPath string) time.Time {
+
+	info, err := os.Stat(filepath.Join(commonGitDir(resolveGitDir(repoPath)), "FETCH_HEAD"))
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
+
+// gitRemoteURL returns the URL of the origin remote, or empty if there is none
+func gitRemoteURL(repoPath string) (string, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	b, _, err := backend.run(ctx, repoPath, "config", "--get", "remote.origin.url")
+
+	var gitErr *gitError
+	if errors.As(err, &gitErr) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
 	return string(bytes.TrimSpace(b)), nil
 }
 
+// parseRemote splits a remote URL into its host and owner, e.g. git@github.com:owner/repo.git.
+// Owners can be nested, like GitLab subgroups. Local paths have neither.
+func parseRemote(remote string) (host string, owner string) {
+
+	var path string
+
+	if strings.Contains(remote, "://") {
+		u, err := url.Parse(remote)
+		if err != nil || u.Scheme == "file" {
+			return "", ""
+		}
+		host, path = u.Hostname(), u.Path
+	} else if i := strings.Index(remote, ":"); i > 0 && !strings.Contains(remote[:i], "/") {
+		// scp-like syntax, user@host:path
+		host, path = remote[:i], remote[i+1:]
+		if at := strings.LastIndex(host, "@"); at >= 0 {
+			host = host[at+1:]
+		}
+	} else {
+		return "", ""
+	}
+
+	path = strings.Trim(strings.TrimSuffix(path, ".git"), "/")
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		owner = path[:i]
+	}
+
+	return strings.ToLower(host), owner
+}
+
+// gitFetch fetches and prunes remote refs, returning how many new commits arrived on the upstream and which remote branches were pruned
+func gitFetch(repoPath string) (fetched int, pruned []string, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Remember where the upstream was so we can count what arrived
+	before, _, _ := backend.run(ctx, repoPath, "rev-parse", "-q", "--verify", "@{upstream}")
+	before = bytes.TrimSpace(before)
+
+	_, stderr, err := backend.run(ctx, repoPath, "fetch", "--prune")
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Git reports pruned refs as " - [deleted] (none) -> origin/branch"
+	for _, line := range strings.Split(string(stderr), "\n") {
+		if strings.Contains(line, "[deleted]") {
+			if i := strings.LastIndex(line, "->"); i >= 0 {
+				pruned = append(pruned, strings.TrimSpace(line[i+2:]))
+			}
+		}
+	}
+
+	// The upstream itself may have just been pruned, then there is nothing new to count
+	after, _, err := backend.run(ctx, repoPath, "rev-parse", "-q", "--verify", "@{upstream}")
+	after = bytes.TrimSpace(after)
+
+	if len(before) > 0 && err == nil && len(after) > 0 {
+		b, _, err := backend.run(ctx, repoPath, "rev-list", "--count", string(before)+".."+string(after))
+		if err != nil {
+			return 0, pruned, err
+		}
+		fetched, err = strconv.Atoi(string(bytes.TrimSpace(b)))
+		if err != nil {
+			return 0, pruned, err
+		}
+	}
+
+	return fetched, pruned, nil
+}
+
+// operationFiles maps files in the git dir to the operation they mean is in progress, checked in order
+var operationFiles = []struct {
+	file      string
+	operation string
+}{
+	{"rebase-merge", "REBASING"},
+	{"rebase-apply/applying", "AM"},
+	{"rebase-apply", "REBASING"},
+	{"MERGE_HEAD", "MERGING"},
+	{"CHERRY_PICK_HEAD", "CHERRY-PICKING"},
+	{"REVERT_HEAD", "REVERTING"},
+	{"BISECT_LOG", "BISECTING"},
+}
+
+// gitOperation returns the operation in progress (rebase, merge etc), or empty if there is none
+func gitOperation(repoPath string) (string, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	b, _, err := backend.run(ctx, repoPath, "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return "", err
+	}
+
+	gitDir := string(bytes.TrimSpace(b))
+
+	for _, v := range operationFiles {
+		if _, err := os.Stat(filepath.Join(gitDir, v.file)); err == nil {
+			return v.operation, nil
+		}
+	}
+
+	return "", nil
+}
+
+// gitStashCount returns the number of stash entries
+func gitStashCount(repoPath string) (int, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	b, _, err := backend.run(ctx, repoPath, "stash", "list")
+	if err != nil {
+		return 0, err
+	}
+
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	return len(bytes.Split(b, []byte("\n"))), nil
+}
+
+// pullStrategies maps --pull-strategy values to git pull flags
+var pullStrategies = map[string][]string{
+	"":        nil, // Use the repo's own pull config
+	"ff-only": {"--ff-only"},
+	"rebase":  {"--rebase"},
+	"merge":   {"--no-rebase"},
+}
+
 // gitPull returns if any files were pulled down
-func gitPull(row rowItem) (bool, error) {
+func gitPull(row rowItem, strategy string) (bool, error) {
+
+	if row.operation != "" {
+		//goland:noinspection GoErrorStringFormat
+		return false, errors.New("Not pulling, repo is " + strings.ToLower(row.operation))
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	b, err := exec.CommandContext(ctx, "git", "-C", row.path, "pull").Output()
+	b, _, err := backend.run(ctx, row.path, append([]string{"pull"}, pullStrategies[strategy]...)...)
 
-	var exitError *exec.ExitError
-	if errors.As(err, &exitError) {
-		if strings.Contains(string(exitError.Stderr), "but no such ref was fetched") {
+	var gitErr *gitError
+	if errors.As(err, &gitErr) {
+		if strings.Contains(gitErr.stderr, "but no such ref was fetched") {
 			if !hasLocalCommits(ctx, row.path) {
 				// Cloned from an empty remote, nothing to pull
 				return false, nil
@@ -96,7 +420,7 @@ func gitPull(row rowItem) (bool, error) {
 			//goland:noinspection GoErrorStringFormat
 			return false, errors.New("Remote branch does not exist")
 		}
-		return false, errors.New(string(exitError.Stderr))
+		return false, err
 	} else if err != nil {
 		return false, err
 	}
@@ -109,7 +433,84 @@ func gitPull(row rowItem) (bool, error) {
 	return strings.Contains(string(b), "changed"), nil
 }
 
+// gitPullAutostash stashes local changes, pulls, and re-applies them.
+// If re-applying conflicts, the changes are left in the stash and conflicted is returned.
+func gitPullAutostash(row rowItem, strategy string) (updated bool, conflicted bool, err error) {
+
+	if row.operation != "" || !row.isDirty() {
+		updated, err = gitPull(row, strategy)
+		return updated, false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Push exits 0 without saving anything when only e.g. submodules are dirty, so check it made a new entry,
+	// otherwise the pop below would apply someone's own older stash
+	before := gitStashRef(ctx, row.path)
+
+	_, _, err = backend.run(ctx, row.path, "stash", "push", "--include-untracked", "-m", "gitstatus autostash")
+	if err != nil {
+		return false, false, err
+	}
+
+	if gitStashRef(ctx, row.path) == before {
+		updated, err = gitPull(row, strategy)
+		return updated, false, err
+	}
+
+	updated, pullErr := gitPull(row, strategy)
+
+	// Always try to put the changes back, even if the pull failed, with a new timeout as the pull may have used it up
+	popCtx, popCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer popCancel()
+
+	_, _, err = backend.run(popCtx, row.path, "stash", "pop")
+	if err != nil {
+		// However the pop failed, the changes are still in the stash
+		var gitErr *gitError
+		if !errors.As(err, &gitErr) {
+			return updated, true, errors.New("changes were left in the stash: " + err.Error())
+		}
+		conflicted = true
+	}
+
+	return updated, conflicted, pullErr
+}
+
+// gitStashRef returns the commit at the top of the stash, blank if there are no entries
+func gitStashRef(ctx context.Context, repoPath string) string {
+
+	stdout, _, err := backend.run(ctx, repoPath, "rev-parse", "-q", "--verify", "refs/stash")
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(stdout))
+}
+
+// gitCheckout switches the working tree to a branch
+func gitCheckout(repoPath string, branch string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, _, err := backend.run(ctx, repoPath, "checkout", branch)
+	return err
+}
+
+// gitBranchExists reports whether a local branch exists
+func gitBranchExists(repoPath string, branch string) bool {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, _, err := backend.run(ctx, repoPath, "rev-parse", "--verify", "-q", "refs/heads/"+branch)
+	return err == nil
+}
+
 // hasLocalCommits reports whether HEAD points at a commit (false in a clone of an empty repo)
 func hasLocalCommits(ctx context.Context, repoPath string) bool {
-	return exec.CommandContext(ctx, "git", "-C", repoPath, "rev-parse", "--verify", "-q", "HEAD").Run() == nil
+	_, _, err := backend.run(ctx, repoPath, "rev-parse", "--verify", "-q", "HEAD")
+	return err == nil
 }
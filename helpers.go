@@ -2,6 +2,12 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func lastLine(s []byte) []byte {
@@ -9,3 +15,93 @@ func lastLine(s []byte) []byte {
 	pieces := bytes.Split(s, []byte("\n"))
 	return pieces[len(pieces)-1]
 }
+
+// expandHome replaces a leading ~ with the user's home directory
+func expandHome(path string) string {
+
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+
+	return filepath.Join(home, path[1:])
+}
+
+// splitList splits comma separated values, as env vars only come through as a single string
+func splitList(values []string) (ret []string) {
+	for _, v := range values {
+		for _, piece := range strings.Split(v, ",") {
+			piece = strings.TrimSpace(piece)
+			if piece != "" {
+				ret = append(ret, piece)
+			}
+		}
+	}
+	return ret
+}
+
+// parseAge parses a duration that can also be in days or weeks, e.g. 30d or 2w
+func parseAge(s string) (time.Duration, error) {
+
+	if s == "" {
+		return 0, nil
+	}
+
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			v, err := strconv.Atoi(n)
+			if err != nil || v < 0 {
+				return 0, fmt.Errorf("invalid age %q", s)
+			}
+			return time.Duration(v) * unit, nil
+		}
+	}
+
+	return time.ParseDuration(s)
+}
+
+// relativeAge describes how long ago a time was, e.g. "3 weeks ago"
+func relativeAge(t time.Time) string {
+
+	d := time.Since(t)
+
+	units := []struct {
+		size time.Duration
+		name string
+	}{
+		{365 * 24 * time.Hour, "year"},
+		{30 * 24 * time.Hour, "month"},
+		{7 * 24 * time.Hour, "week"},
+		{24 * time.Hour, "day"},
+		{time.Hour, "hour"},
+		{time.Minute, "minute"},
+	}
+
+	for _, u := range units {
+		if n := int(d / u.size); n >= 1 {
+			if n == 1 {
+				return "1 " + u.name + " ago"
+			}
+			return strconv.Itoa(n) + " " + u.name + "s ago"
+		}
+	}
+
+	return "just now"
+}
+
+// trimRoot strips the root dir a path is under, the longest one if roots overlap
+func trimRoot(path string, roots []string) string {
+
+	var longest string
+	for _, root := range roots {
+		if (path == root || strings.HasPrefix(path, root+string(filepath.Separator))) && len(root) > len(longest) {
+			longest = root
+		}
+	}
+
+	return strings.TrimPrefix(path, longest)
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/cheggaaa/pb/v3"
@@ -24,7 +28,44 @@ const (
 	fMaxdepth = "maxdepth"
 	fShort    = "short"
 	fPull     = "pull"
+	fFetch    = "fetch"
 	fAll      = "all"
+	fOutput   = "output"
+	fConfig   = "config"
+	fProfile  = "profile"
+
+	fMainBranches = "main-branches"
+	fDetectMain   = "detect-main"
+	fPullStrategy = "pull-strategy"
+	fAutostash    = "autostash"
+	fDebounce     = "debounce"
+	fNoCache      = "no-cache"
+	fSinceLast    = "since-last"
+	fDetailed     = "detailed"
+	fSort         = "sort"
+	fReverse      = "reverse"
+	fGroupBy      = "group-by"
+	fColumns      = "columns"
+	fFormat       = "format"
+	fFailOn       = "fail-on"
+	fStale        = "stale"
+	fOnly         = "only"
+	fHide         = "hide"
+	fExclude      = "exclude"
+)
+
+// Exit codes, so scripts can gate on the state of the repos
+const (
+	exitClean     = 0 // Nothing to report
+	exitAttention = 1 // Some repos need attention, or match --fail-on
+	exitErrored   = 2 // Some repos could not be read or pulled
+	exitFailed    = 3 // The run itself failed, e.g. bad flags or config
+)
+
+const (
+	formatTable  = "table"
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
 )
 
 // These variables are set by goreleaser's ldflags
@@ -38,13 +79,40 @@ func init() {
 
 	log.SetFlags(0)
 
-	cmd.Flags().StringP(fDir, "d", "", "Directory")
-	cmd.Flags().StringP(fFilter, "f", "", "Filter")
+	cmd.PersistentFlags().StringSliceP(fDir, "d", nil, "Directories, can be repeated")
+	cmd.PersistentFlags().StringP(fFilter, "f", "", "Filter")
 	cmd.Flags().BoolP(fVersion, "v", false, "Version")
-	cmd.Flags().IntP(fMaxdepth, "m", 2, "Max Depth")
-	cmd.Flags().BoolP(fShort, "s", false, "Short Paths")
+	cmd.PersistentFlags().IntP(fMaxdepth, "m", 2, "Max Depth")
+	cmd.PersistentFlags().StringSlice(fExclude, nil, "Directories to skip, e.g. node_modules,vendor")
+	cmd.PersistentFlags().BoolP(fShort, "s", false, "Short Paths")
 	cmd.Flags().BoolP(fPull, "p", false, "Pull Repos")
+	cmd.Flags().BoolP(fFetch, "F", false, "Fetch Repos")
+	cmd.Flags().String(fPullStrategy, "", "Pull Strategy (ff-only, rebase, merge)")
+	cmd.Flags().Bool(fAutostash, false, "Stash changes to pull dirty Repos")
+	cmd.Flags().Bool(fNoCache, false, "Ignore cached results from the last run")
+	cmd.Flags().Bool(fSinceLast, false, "Only show what changed since the last run")
+	cmd.Flags().Bool(fDetailed, false, "Show staged, unstaged, untracked, renamed and conflicted counts")
+	cmd.Flags().String(fSort, "path", "Sort by (path, branch, changes, behind, ahead, last-commit, error)")
+	cmd.Flags().Bool(fReverse, false, "Reverse the sort order")
+	cmd.Flags().String(fGroupBy, "", "Group rows by (parent, remote-host, owner, branch)")
+	cmd.Flags().String(fStale, "", "Only show Repos with no commit or fetch for this long, e.g. 30d")
+	cmd.Flags().StringSlice(fOnly, nil, "Only show Repos in any of these states (dirty, ahead, behind, off-main, detached, error, updated)")
+	cmd.Flags().StringSlice(fHide, nil, "Hide Repos in any of these states")
 	cmd.Flags().BoolP(fAll, "a", false, "Show all Repos")
+	cmd.Flags().StringP(fOutput, "o", formatTable, "Output format (table, json, ndjson)")
+	cmd.Flags().StringSlice(fColumns, nil, "Table columns (repo, branch, changes, sync, ahead, behind, state, last-commit, remote...)")
+	cmd.Flags().String(fFormat, "", "Go template for each row, e.g. '{{.Path}} {{.Branch}}'")
+	cmd.Flags().StringSlice(fFailOn, nil, "Only exit non-zero for these states (dirty, behind, ahead, error, off-main...)")
+	cmd.PersistentFlags().StringP(fConfig, "c", "", "Config File")
+	cmd.PersistentFlags().StringP(fProfile, "P", "", "Config Profile")
+	cmd.Flags().StringSlice(fMainBranches, defaultMainBranches, "Main Branch Names")
+	cmd.Flags().Bool(fDetectMain, false, "Detect Main Branch from origin/HEAD")
+
+	watchCmd.Flags().Duration(fDebounce, 500*time.Millisecond, "Wait for changes to settle before refreshing")
+
+	cmd.AddCommand(execCmd)
+	cmd.AddCommand(tuiCmd)
+	cmd.AddCommand(watchCmd)
 
 	cobra.OnInitialize(func() {
 
@@ -52,21 +120,91 @@ func init() {
 		viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 		viper.AutomaticEnv()
 
-		_ = viper.BindPFlag(fDir, cmd.Flags().Lookup(fDir))
-		_ = viper.BindPFlag(fFilter, cmd.Flags().Lookup(fFilter))
+		_ = viper.BindPFlag(fDir, cmd.PersistentFlags().Lookup(fDir))
+		_ = viper.BindPFlag(fFilter, cmd.PersistentFlags().Lookup(fFilter))
 		_ = viper.BindPFlag(fVersion, cmd.Flags().Lookup(fVersion))
-		_ = viper.BindPFlag(fMaxdepth, cmd.Flags().Lookup(fMaxdepth))
-		_ = viper.BindPFlag(fShort, cmd.Flags().Lookup(fShort))
+		_ = viper.BindPFlag(fMaxdepth, cmd.PersistentFlags().Lookup(fMaxdepth))
+		_ = viper.BindPFlag(fExclude, cmd.PersistentFlags().Lookup(fExclude))
+		_ = viper.BindPFlag(fShort, cmd.PersistentFlags().Lookup(fShort))
 		_ = viper.BindPFlag(fPull, cmd.Flags().Lookup(fPull))
+		_ = viper.BindPFlag(fFetch, cmd.Flags().Lookup(fFetch))
+		_ = viper.BindPFlag(fPullStrategy, cmd.Flags().Lookup(fPullStrategy))
+		_ = viper.BindPFlag(fAutostash, cmd.Flags().Lookup(fAutostash))
+		_ = viper.BindPFlag(fDebounce, watchCmd.Flags().Lookup(fDebounce))
+		_ = viper.BindPFlag(fNoCache, cmd.Flags().Lookup(fNoCache))
+		_ = viper.BindPFlag(fSinceLast, cmd.Flags().Lookup(fSinceLast))
+		_ = viper.BindPFlag(fDetailed, cmd.Flags().Lookup(fDetailed))
+		_ = viper.BindPFlag(fSort, cmd.Flags().Lookup(fSort))
+		_ = viper.BindPFlag(fReverse, cmd.Flags().Lookup(fReverse))
+		_ = viper.BindPFlag(fGroupBy, cmd.Flags().Lookup(fGroupBy))
+		_ = viper.BindPFlag(fStale, cmd.Flags().Lookup(fStale))
+		_ = viper.BindPFlag(fOnly, cmd.Flags().Lookup(fOnly))
+		_ = viper.BindPFlag(fHide, cmd.Flags().Lookup(fHide))
 		_ = viper.BindPFlag(fAll, cmd.Flags().Lookup(fAll))
+		_ = viper.BindPFlag(fOutput, cmd.Flags().Lookup(fOutput))
+		_ = viper.BindPFlag(fColumns, cmd.Flags().Lookup(fColumns))
+		_ = viper.BindPFlag(fFormat, cmd.Flags().Lookup(fFormat))
+		_ = viper.BindPFlag(fFailOn, cmd.Flags().Lookup(fFailOn))
+		_ = viper.BindPFlag(fConfig, cmd.PersistentFlags().Lookup(fConfig))
+		_ = viper.BindPFlag(fProfile, cmd.PersistentFlags().Lookup(fProfile))
+		_ = viper.BindPFlag(fMainBranches, cmd.Flags().Lookup(fMainBranches))
+		_ = viper.BindPFlag(fDetectMain, cmd.Flags().Lookup(fDetectMain))
 	})
 }
 
+// exitCode is set by the root command once it knows the state of the repos
+var exitCode = exitClean
+
 func main() {
 	if err := cmd.Execute(); err != nil {
 		log.Println(err)
-		os.Exit(1)
+		os.Exit(exitFailed)
+	}
+	os.Exit(exitCode)
+}
+
+// checkStates returns an error for the first unknown state in the --only, --hide or --fail-on flags
+func checkStates() error {
+	for _, flag := range []string{fOnly, fHide, fFailOn} {
+		for _, name := range splitList(viper.GetStringSlice(flag)) {
+			if _, ok := rowStates[name]; !ok {
+				return fmt.Errorf("unknown state for --%s: %s", flag, name)
+			}
+		}
 	}
+	return nil
+}
+
+// rowsExitCode returns exitErrored if any repo failed, or exitAttention if any has something to report.
+// With --fail-on, only the listed conditions count.
+func rowsExitCode(rows []rowItem) int {
+
+	conditions := splitList(viper.GetStringSlice(fFailOn))
+
+	code := exitClean
+	for _, row := range rows {
+
+		if len(conditions) == 0 {
+			if row.error != nil {
+				return exitErrored
+			}
+			if row.needsAttention() {
+				code = exitAttention
+			}
+			continue
+		}
+
+		for _, name := range conditions {
+			if rowStates[name](row) {
+				if name == "error" {
+					return exitErrored
+				}
+				code = exitAttention
+			}
+		}
+	}
+
+	return code
 }
 
 var cmd = &cobra.Command{
@@ -81,223 +219,909 @@ var cmd = &cobra.Command{
 			return
 		}
 
-		// Get the base code dir
-		baseDir := viper.GetString(fDir)
-		if baseDir == "" {
-			home, err := os.UserHomeDir()
+		if err := loadConfig(); err != nil {
+			log.Println("unable to load config: " + err.Error())
+			exitCode = exitFailed
+			return
+		}
+
+		output := viper.GetString(fOutput)
+		if output != formatTable && output != formatJSON && output != formatNDJSON {
+			log.Println("unknown output format: " + output)
+			exitCode = exitFailed
+			return
+		}
+
+		if _, ok := pullStrategies[viper.GetString(fPullStrategy)]; !ok {
+			log.Println("unknown pull strategy: " + viper.GetString(fPullStrategy))
+			exitCode = exitFailed
+			return
+		}
+
+		if _, ok := rowSorts[viper.GetString(fSort)]; !ok {
+			log.Println("unknown sort: " + viper.GetString(fSort))
+			exitCode = exitFailed
+			return
+		}
+
+		if _, ok := rowGroups[viper.GetString(fGroupBy)]; !ok {
+			log.Println("unknown group: " + viper.GetString(fGroupBy))
+			exitCode = exitFailed
+			return
+		}
+
+		if _, err := parseAge(viper.GetString(fStale)); err != nil {
+			log.Println("unable to parse stale: " + err.Error())
+			exitCode = exitFailed
+			return
+		}
+
+		if err := checkStates(); err != nil {
+			log.Println(err)
+			exitCode = exitFailed
+			return
+		}
+
+		if err := checkColumns(); err != nil {
+			log.Println(err)
+			exitCode = exitFailed
+			return
+		}
+
+		var tmpl *template.Template
+		if format := viper.GetString(fFormat); format != "" {
+			var err error
+			tmpl, err = parseFormat(format)
 			if err != nil {
-				log.Println("unable to determine home directory: " + err.Error())
+				log.Println("invalid format: " + err.Error())
+				exitCode = exitFailed
 				return
 			}
-			baseDir = filepath.Join(home, "code")
 		}
 
-		// Get a list of every repo
-		repos := scanAllDirs(baseDir, 1)
-		if len(repos) == 0 {
-			log.Println(baseDir + " does not contain any repos")
+		roots, ok := rootDirs()
+		if !ok {
+			exitCode = exitFailed
 			return
 		}
 
-		// Filter by filter flag
-		repos = filterReposByFilterFlag(repos)
-		if len(repos) == 0 {
-			log.Println("No repos match your directory & filter")
+		// Only --since-last needs the snapshot, a plain run still works without one
+		snapPath, err := snapshotPath()
+		if err != nil {
+			log.Println("unable to find snapshot: " + err.Error())
+			if viper.GetBool(fSinceLast) {
+				exitCode = exitFailed
+				return
+			}
+		}
+
+		// Reuse results for repos that have not changed since the last run
+		if !viper.GetBool(fNoCache) {
+			if path, err := cachePath(); err == nil {
+				statusCache = loadCache(path)
+			}
+		}
+
+		// Pull repos with a loading bar, starting as soon as the first one is found
+		var total int
+		rows := pullRepos(streamRepos(roots, &total))
+		if len(rows) == 0 {
+			reportNoRepos(roots, total)
+			exitCode = exitFailed
 			return
 		}
 
-		// Pull repos with a loading bar
-		rows := pullRepos(repos)
+		if statusCache != nil {
+			if err := statusCache.save(); err != nil {
+				log.Println("unable to save cache: " + err.Error())
+			}
+		}
 
-		// Show a table of results
-		outputTable(rows, baseDir)
+		// Compare with the last run
+		snap := snapshot{}
+		if snapPath != "" {
+			snap, err = loadSnapshot(snapPath)
+			if err != nil {
+				log.Println("unable to load snapshot: " + err.Error())
+				snap = snapshot{}
+			}
+		}
+
+		gone := snap.goneRepos(rows, roots)
+
+		// Show the results
+		switch {
+		case viper.GetBool(fSinceLast) && output == formatTable:
+			outputChanges(snap.diff(rows, gone), roots)
+		case viper.GetBool(fSinceLast):
+			outputChangesJSON(snap.diff(rows, gone), output == formatNDJSON)
+		case tmpl != nil:
+			outputFormat(rows, roots, tmpl)
+		case output == formatTable:
+			outputTable(rows, roots)
+		default:
+			outputJSON(rows, roots, output == formatNDJSON)
+		}
+
+		if snapPath != "" {
+			if err = snap.update(rows, gone).save(snapPath); err != nil {
+				log.Println("unable to save snapshot: " + err.Error())
+			}
+		}
+
+		exitCode = rowsExitCode(rows)
 	},
 }
 
+// findRepos returns every repo in the root dirs that matches the filter
+func findRepos() (repos []repoItem, roots []string, ok bool) {
+
+	roots, ok = rootDirs()
+	if !ok {
+		return nil, nil, false
+	}
+
+	var total int
+	for repo := range streamRepos(roots, &total) {
+		repos = append(repos, repo)
+	}
+
+	if len(repos) == 0 {
+		reportNoRepos(roots, total)
+		return nil, nil, false
+	}
+
+	return repos, roots, true
+}
+
+// rootDirs returns the dirs to look for repos in, after checking the flags that control the search
+func rootDirs() (roots []string, ok bool) {
+
+	if _, err := parseFilter(viper.GetString(fFilter)); err != nil {
+		log.Println("invalid filter: " + err.Error())
+		return nil, false
+	}
+
+	for _, pattern := range splitList(viper.GetStringSlice(fExclude)) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			log.Println("invalid exclude: " + pattern)
+			return nil, false
+		}
+	}
+
+	for _, dir := range splitList(viper.GetStringSlice(fDir)) {
+		roots = append(roots, filepath.Clean(expandHome(dir)))
+	}
+	if len(roots) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			log.Println("unable to determine home directory: " + err.Error())
+			return nil, false
+		}
+		roots = []string{filepath.Join(home, "code")}
+	}
+
+	return roots, true
+}
+
+// streamRepos sends each repo in the root dirs that matches the filter as soon as it is found, closing the channel
+// once discovery has finished. Repos reached from more than one root are only sent once, under the first root listed.
+// After the channel is closed, total holds how many repos were found before filtering.
+func streamRepos(roots []string, total *int) <-chan repoItem {
+
+	patterns, _ := parseFilter(viper.GetString(fFilter)) // Checked by rootDirs
+
+	roots = uniqueDirs(roots)
+
+	realRoots := make([]string, len(roots))
+	for i, root := range roots {
+		realRoots[i] = realPath(root)
+	}
+
+	out := make(chan repoItem)
+
+	go func() {
+
+		defer close(out)
+
+		seen := map[string]bool{}
+		for repo := range scanDirs(roots, 1) {
+
+			key := realPath(repo.path)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			*total++
+
+			// Whichever root's walk got here first, show it the same way every run
+			repo.path = preferredPath(repo.path, key, roots, realRoots)
+
+			if matchesFilter(patterns, repo.path) {
+				out <- repo
+			}
+		}
+	}()
+
+	return out
+}
+
+// preferredPath returns the path to a repo through the first root that contains it once symlinks are followed, so the
+// cache, snapshot and --short paths do not depend on which root's walk found it first
+func preferredPath(path string, real string, roots []string, realRoots []string) string {
+
+	for i, realRoot := range realRoots {
+		if rel, err := filepath.Rel(realRoot, real); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return filepath.Join(roots[i], rel)
+		}
+	}
+
+	return path
+}
+
+// uniqueDirs drops dirs that are the same as an earlier one once symlinks are followed, so they are not walked twice
+func uniqueDirs(dirs []string) (ret []string) {
+
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		if key := realPath(dir); !seen[key] {
+			seen[key] = true
+			ret = append(ret, dir)
+		}
+	}
+
+	return ret
+}
+
+func realPath(path string) string {
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		return real
+	}
+	return path
+}
+
+// reportNoRepos explains why there is nothing to show
+func reportNoRepos(roots []string, total int) {
+	if total == 0 {
+		log.Println(strings.Join(roots, ", ") + " does not contain any repos")
+	} else {
+		log.Println("No repos match your directory & filter")
+	}
+}
+
 type repoItem struct {
-	path string
-	size int64
+	path       string
+	size       int64
+	worktreeOf string   // Main repo path, for linked worktrees
+	excludes   []string // Exclude patterns in effect where the repo was found
 }
 
-func scanAllDirs(dir string, depth int) (ret []repoItem) {
+// ignoreFile lists exclude patterns for the directory it is in and everything below it
+const ignoreFile = ".gitstatusignore"
 
-	if depth > viper.GetInt(fMaxdepth) {
-		return nil
+// scanDirs walks the dirs concurrently, sending each repo as soon as it is found, and closing the channel when done
+func scanDirs(dirs []string, depth int) <-chan repoItem {
+
+	var excludes []string
+	for _, pattern := range splitList(viper.GetStringSlice(fExclude)) {
+		excludes = append(excludes, expandHome(pattern))
 	}
 
+	found := make(chan repoItem)
+	s := &dirScanner{sem: make(chan struct{}, 16), found: found, maxdepth: viper.GetInt(fMaxdepth)}
+
+	for _, dir := range dirs {
+		s.wg.Add(1)
+		go s.scan(dir, depth, excludes)
+	}
+
+	go func() {
+		s.wg.Wait()
+		close(found)
+	}()
+
+	return found
+}
+
+// dirScanner reads directories in parallel, each subdirectory is scanned in its own goroutine
+type dirScanner struct {
+	wg       sync.WaitGroup
+	sem      chan struct{} // Limits how many directories are read at once
+	found    chan<- repoItem
+	maxdepth int
+}
+
+// scan looks for repos under dir, skipping directories that match an exclude pattern without reading them
+func (s *dirScanner) scan(dir string, depth int, excludes []string) {
+
+	defer s.wg.Done()
+
+	if depth > s.maxdepth {
+		return
+	}
+
+	s.sem <- struct{}{}
 	entries, err := os.ReadDir(dir)
+	<-s.sem
+
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
+	for _, e := range entries {
+		if e.Name() == ignoreFile && !e.IsDir() {
+			excludes = append(slices.Clip(excludes), readIgnoreFile(filepath.Join(dir, ignoreFile))...)
+		}
+	}
+
 	for _, e := range entries {
 		if e.IsDir() {
 
 			d := filepath.Join(dir, e.Name())
 
+			if isExcluded(d, excludes) {
+				continue
+			}
+
 			if _, err := os.Stat(filepath.Join(d, ".git")); err != nil {
-				ret = append(ret, scanAllDirs(d, depth+1)...)
+				s.wg.Add(1)
+				go s.scan(d, depth+1, excludes)
 			} else {
-				var size int64
-				if idx, err := os.Stat(filepath.Join(d, ".git", "index")); err == nil {
-					size = idx.Size()
+				gitDir := resolveGitDir(d)
+				repo := repoItem{path: d, size: indexSize(gitDir), worktreeOf: mainRepoOf(gitDir), excludes: excludes}
+				s.found <- repo
+				if repo.worktreeOf == "" {
+					for _, wt := range linkedWorktrees(d, gitDir) {
+						wt.excludes = excludes
+						s.found <- wt
+					}
 				}
-				ret = append(ret, repoItem{path: d, size: size})
 			}
 		}
 	}
+}
 
-	return ret
+// readIgnoreFile returns the patterns in an ignore file, one per line, skipping blanks and # comments
+func readIgnoreFile(path string) (patterns []string) {
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			patterns = append(patterns, line)
+		}
+	}
+
+	return patterns
 }
 
-func filterReposByFilterFlag(repos []repoItem) (ret []repoItem) {
+// isExcluded reports whether a directory matches any exclude pattern. Patterns are globs on the directory name, or on
+// the end of the path if they contain a slash, like --filter globs.
+func isExcluded(dir string, patterns []string) bool {
 
-	var filter = viper.GetString(fFilter)
-	if filter == "" {
-		return repos
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(pattern, "/")
+		if ok, _ := filepath.Match(pattern, globSubject(dir, pattern)); ok {
+			return true
+		}
 	}
 
-	pieces := strings.Split(filter, ",")
-	var includes, excludes []string
-	for _, piece := range pieces {
-		piece = strings.TrimSpace(strings.ToLower(piece))
-		if strings.HasPrefix(piece, "!") {
-			excludes = append(excludes, piece)
-		} else {
-			includes = append(includes, piece)
+	return false
+}
+
+// resolveGitDir returns the git dir for a repo, following `gitdir:` files used by worktrees and submodules
+func resolveGitDir(repoPath string) string {
+
+	dotGit := filepath.Join(repoPath, ".git")
+
+	b, err := os.ReadFile(dotGit)
+	if err != nil {
+		return dotGit // A directory, or unreadable
+	}
+
+	gitDir := strings.TrimSpace(strings.TrimPrefix(string(lastLine(b)), "gitdir:"))
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(repoPath, gitDir)
+	}
+
+	return filepath.Clean(gitDir)
+}
+
+// commonGitDir returns the git dir shared by all worktrees, where refs are kept
+func commonGitDir(gitDir string) string {
+
+	b, err := os.ReadFile(filepath.Join(gitDir, "commondir"))
+	if err != nil {
+		return gitDir
+	}
+
+	common := strings.TrimSpace(string(b))
+	if !filepath.IsAbs(common) {
+		common = filepath.Join(gitDir, common)
+	}
+
+	return filepath.Clean(common)
+}
+
+// mainRepoOf returns the main repo path if the git dir belongs to a linked worktree
+func mainRepoOf(gitDir string) string {
+
+	common := commonGitDir(gitDir)
+	if common == gitDir {
+		return ""
+	}
+
+	if filepath.Base(common) == ".git" {
+		return filepath.Dir(common)
+	}
+	return common
+}
+
+// linkedWorktrees returns the worktrees attached to a main repo
+func linkedWorktrees(repoPath string, gitDir string) (ret []repoItem) {
+
+	entries, err := os.ReadDir(filepath.Join(gitDir, "worktrees"))
+	if err != nil {
+		return nil
+	}
+
+	for _, e := range entries {
+
+		wtGitDir := filepath.Join(gitDir, "worktrees", e.Name())
+
+		// Points at the .git file inside the worktree
+		b, err := os.ReadFile(filepath.Join(wtGitDir, "gitdir"))
+		if err != nil {
+			continue
 		}
+
+		wt := filepath.Dir(strings.TrimSpace(string(b)))
+		if _, err := os.Stat(wt); err != nil {
+			continue // Deleted without `git worktree prune`
+		}
+
+		ret = append(ret, repoItem{path: wt, size: indexSize(wtGitDir), worktreeOf: repoPath})
 	}
 
-	for _, repo := range repos {
+	return ret
+}
 
-		repoPath := strings.ToLower(repo.path)
+func indexSize(gitDir string) int64 {
+	if idx, err := os.Stat(filepath.Join(gitDir, "index")); err == nil {
+		return idx.Size()
+	}
+	return 0
+}
 
-		// Check positives
-		if len(includes) > 0 {
-			matched := false
-			for _, v := range includes {
-				if v != "" && strings.Contains(repoPath, v) {
-					matched = true
-					break
-				}
+// filterPattern is one comma separated piece of --filter
+type filterPattern struct {
+	exclude bool
+	match   func(repoPath string) bool
+}
+
+// parseFilter parses --filter. Plain pieces match a case-insensitive substring of the full path.
+// Pieces starting glob: or re: must match all of the basename, or of the path if the pattern has a slash in it.
+// Any piece can be negated with a leading !
+func parseFilter(filter string) (patterns []filterPattern, err error) {
+
+	for _, piece := range splitFilter(filter) {
+
+		piece = strings.TrimSpace(piece)
+
+		var p filterPattern
+		piece, p.exclude = strings.CutPrefix(piece, "!")
+		if piece == "" {
+			continue
+		}
+
+		if pattern, ok := strings.CutPrefix(piece, "glob:"); ok {
+
+			pattern = strings.ToLower(pattern)
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("bad glob %q: %w", pattern, err)
 			}
-			if !matched {
-				continue
+
+			p.match = func(repoPath string) bool {
+				ok, _ := filepath.Match(pattern, globSubject(strings.ToLower(repoPath), pattern))
+				return ok
 			}
-		}
 
-		// Check negatives
-		excluded := false
-		for _, v := range excludes {
-			v = strings.TrimPrefix(v, "!")
-			if v != "" && strings.Contains(repoPath, v) {
-				excluded = true
-				break
+		} else if pattern, ok := strings.CutPrefix(piece, "re:"); ok {
+
+			if _, err := regexp.Compile(pattern); err != nil {
+				return nil, fmt.Errorf("bad regex %q: %w", pattern, err)
+			}
+			re := regexp.MustCompile("(?i)^(?:" + pattern + ")$")
+
+			p.match = func(repoPath string) bool {
+				return re.MatchString(globSubject(repoPath, pattern))
+			}
+
+		} else {
+
+			piece = strings.ToLower(piece)
+			p.match = func(repoPath string) bool {
+				return strings.Contains(strings.ToLower(repoPath), piece)
 			}
 		}
-		if excluded {
-			continue
+
+		patterns = append(patterns, p)
+	}
+
+	return patterns, nil
+}
+
+// splitFilter splits a filter on commas, except inside brackets and braces so regexes like "a{1,2}" stay whole
+func splitFilter(filter string) (pieces []string) {
+
+	var depth, start int
+	for i, r := range filter {
+		switch r {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth = max(depth-1, 0)
+		case ',':
+			if depth == 0 {
+				pieces = append(pieces, filter[start:i])
+				start = i + 1
+			}
 		}
+	}
 
-		ret = append(ret, repo)
+	return append(pieces, filter[start:])
+}
+
+// globSubject returns the end of a path with as many segments as the glob or regex has, so "org/*" matches any repo in
+// an org dir. Absolute patterns match the whole path.
+func globSubject(repoPath string, pattern string) string {
+
+	if strings.HasPrefix(pattern, "/") {
+		return repoPath
+	}
+
+	segments := strings.Split(repoPath, "/")
+	n := strings.Count(pattern, "/") + 1
+	if n >= len(segments) {
+		return repoPath
+	}
+
+	return strings.Join(segments[len(segments)-n:], "/")
+}
+
+func filterReposByFilterFlag(repos []repoItem) (ret []repoItem) {
+
+	patterns, err := parseFilter(viper.GetString(fFilter))
+	if err != nil {
+		return nil // Checked by rootDirs
+	}
+
+	for _, repo := range repos {
+		if matchesFilter(patterns, repo.path) {
+			ret = append(ret, repo)
+		}
 	}
 
 	return ret
 }
 
-func pullRepos(repos []repoItem) (rows []rowItem) {
+// matchesFilter is true if a path matches any include pattern (or there are none), and no exclude patterns
+func matchesFilter(patterns []filterPattern, repoPath string) bool {
 
-	// Run large repos first so you are not waiting on them at the end
-	sort.Slice(repos, func(i, j int) bool {
-		return repos[i].size > repos[j].size
-	})
+	var hasIncludes, included bool
+	for _, p := range patterns {
+		if !p.exclude {
+			hasIncludes = true
+		}
+		if p.match(repoPath) {
+			if p.exclude {
+				return false
+			}
+			included = true
+		}
+	}
+
+	return included || !hasIncludes
+}
+
+// forEachRepo runs fn on every repo with a bounded worker pool and a loading bar
+func forEachRepo(repos []repoItem, fn func(r repoItem)) {
+	forEachRepoStream(sortedRepos(repos), fn)
+}
+
+// forEachRepoStream runs fn on repos as they are found, the loading bar's total grows as they arrive
+func forEachRepoStream(repos <-chan repoItem, fn func(r repoItem)) {
 
 	//
-	bar := pb.New(len(repos))
+	bar := pb.New(0)
 	bar.SetRefreshRate(time.Millisecond * 200)
 	bar.SetWriter(os.Stdout)
 	bar.SetWidth(100)
-	bar.Start()
 
-	wg := sync.WaitGroup{}
-	sem := make(chan struct{}, 10)
+	// Keep stdout clean for machine-readable output
+	showBar := viper.GetString(fOutput) == formatTable && viper.GetString(fFormat) == ""
+
+	// The bar is only started once there is a repo, so an empty dir just shows its message
+	counted := make(chan repoItem)
+	go func() {
+		defer close(counted)
+		for r := range repos {
+			bar.AddTotal(1)
+			if showBar && !bar.IsStarted() {
+				bar.Start()
+			}
+			counted <- r
+		}
+	}()
 
-	var mu sync.Mutex
+	poolRepoStream(counted, func(r repoItem) {
+		defer bar.Increment()
+		fn(r)
+	})
 
-	for _, r := range repos {
+	if bar.IsStarted() {
+		bar.Finish()
+	}
+}
 
-		wg.Add(1)
-		go func(r repoItem) {
-			sem <- struct{}{}
-			defer func() {
-				<-sem
-				wg.Done()
-			}()
+// poolRepos runs fn on every repo with a bounded worker pool
+func poolRepos(repos []repoItem, fn func(r repoItem)) {
+	poolRepoStream(sortedRepos(repos), fn)
+}
+
+// sortedRepos sends large repos first so you are not waiting on them at the end
+func sortedRepos(repos []repoItem) <-chan repoItem {
+
+	sort.Slice(repos, func(i, j int) bool {
+		return repos[i].size > repos[j].size
+	})
 
-			defer bar.Increment()
+	ch := make(chan repoItem)
+	go func() {
+		defer close(ch)
+		for _, r := range repos {
+			ch <- r
+		}
+	}()
 
-			// Make row
-			row := rowItem{path: r.path}
+	return ch
+}
 
-			defer func() {
-				mu.Lock()
-				rows = append(rows, row)
-				mu.Unlock()
-			}()
+// poolRepoStream runs fn on repos as they arrive, with a bounded worker pool
+func poolRepoStream(repos <-chan repoItem, fn func(r repoItem)) {
 
-			var err error
+	wg := sync.WaitGroup{}
 
-			row.changedFiles, err = gitDiff(r.path)
-			if err != nil {
-				row.error = err
-				return
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range repos {
+				fn(r)
 			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func pullRepos(repos <-chan repoItem) (rows []rowItem) {
+
+	var mu sync.Mutex
+
+	forEachRepoStream(repos, func(r repoItem) {
+		row := pullRepo(r)
+		mu.Lock()
+		rows = append(rows, row)
+		mu.Unlock()
+	})
+
+	return rows
+}
+
+// pullRepo gathers the status of a single repo, fetching and pulling it if the flags ask to
+func pullRepo(r repoItem) rowItem {
+
+	fetch, pull := viper.GetBool(fFetch), viper.GetBool(fPull)
+
+	// Fetching and pulling always need to hit the remote
+	if statusCache != nil && !fetch && !pull {
+		if row, ok := statusCache.get(r); ok {
 
-			row.branch, err = gitBranch(r.path)
+			// Edits to the working tree are not covered by the fingerprint, so changes are always read
+			changes, err := gitDiff(r.path)
 			if err != nil {
 				row.error = err
-				return
+				return row
 			}
+			row.changes = changes
+			row.changedFiles = changes.String()
 
-			// Pull
-			if viper.GetBool(fPull) && !row.isDirty() {
-				row.updated, err = gitPull(row)
-				if err != nil {
-					row.error = err
-					return
-				}
-			}
-		}(r)
+			return row
+		}
 	}
 
-	wg.Wait()
+	row := readRepo(r, fetch, pull)
 
-	bar.Finish()
+	if statusCache != nil {
+		statusCache.put(row)
+	}
 
-	return rows
+	return row
+}
+
+// readRepo gathers the status of a single repo, optionally fetching and pulling it first
+func readRepo(r repoItem, fetch bool, pull bool) (row rowItem) {
+
+	row = rowItem{path: r.path, worktreeOf: r.worktreeOf, mainBranches: mainBranches(r.path)}
+
+	var err error
+
+	row.changes, err = gitDiff(r.path)
+	if err != nil {
+		row.error = err
+		return row
+	}
+	row.changedFiles = row.changes.String()
+
+	row.branch, err = gitBranch(r.path)
+	if err != nil {
+		row.error = err
+		return row
+	}
+
+	row.operation, err = gitOperation(r.path)
+	if err != nil {
+		row.error = err
+		return row
+	}
+
+	row.stashes, err = gitStashCount(r.path)
+	if err != nil {
+		row.error = err
+		return row
+	}
+
+	row.lastCommit, err = gitLastCommit(r.path)
+	if err != nil {
+		row.error = err
+		return row
+	}
+
+	row.remote, err = gitRemoteURL(r.path)
+	if err != nil {
+		row.error = err
+		return row
+	}
+
+	if viper.GetBool(fDetectMain) {
+		row.defaultBranch, err = gitDefaultBranch(r.path)
+		if err != nil {
+			row.error = err
+			return row
+		}
+	}
+
+	// Fetch, even on dirty repos as it does not touch the working tree
+	if fetch {
+		row.fetched, row.pruned, err = gitFetch(r.path)
+		if err != nil {
+			row.error = err
+			return row
+		}
+	}
+
+	// Pull
+	if pull {
+		if viper.GetBool(fAutostash) {
+			row.updated, row.stashConflict, err = gitPullAutostash(row, viper.GetString(fPullStrategy))
+		} else if !row.isDirty() {
+			row.updated, err = gitPull(row, viper.GetString(fPullStrategy))
+		}
+		if err != nil {
+			row.error = err
+			return row
+		}
+	}
+
+	row.lastFetch = lastFetchTime(r.path)
+
+	row.ahead, row.behind, err = gitAheadBehind(r.path)
+	if err != nil {
+		row.error = err
+		return row
+	}
+
+	return row
 }
 
-func outputTable(rows []rowItem, baseDir string) {
+// sortRows puts conflicted repos first as they need attention, then sorts by the --sort flag and path,
+// with linked worktrees grouped under their main repo
+func sortRows(rows []rowItem) {
+
+	by := rowSorts[viper.GetString(fSort)]
+	reverse := viper.GetBool(fReverse)
 
 	sort.Slice(rows, func(i, j int) bool {
-		return strings.ToLower(rows[i].path) < strings.ToLower(rows[j].path)
-	})
 
-	var hasErrors bool
-	for _, v := range rows {
-		if v.error != nil {
-			hasErrors = true
-			break
+		a, b := rows[i], rows[j]
+
+		if a.isConflicted() != b.isConflicted() {
+			return a.isConflicted()
+		}
+
+		c := 0
+		if by != nil {
+			c = by(a, b)
+		}
+		if c == 0 {
+			c = strings.Compare(strings.ToLower(a.group()), strings.ToLower(b.group()))
+		}
+		if c == 0 && (a.worktreeOf == "") != (b.worktreeOf == "") {
+			return a.worktreeOf == ""
+		}
+		if c == 0 {
+			c = strings.Compare(strings.ToLower(a.path), strings.ToLower(b.path))
+		}
+
+		if reverse {
+			return c > 0
 		}
+		return c < 0
+	})
+}
+
+// groupRows orders rows into the --group-by sections, keeping the sorted order within each one
+func groupRows(rows []rowItem, roots []string) (sections []string) {
+
+	by := rowGroups[viper.GetString(fGroupBy)]
+	if by == nil {
+		return nil
 	}
 
-	header := table.Row{"Repo", "Branch", "Changes"}
-	if viper.GetBool(fPull) {
-		header = append(header, "Pull")
+	sections = make([]string, len(rows))
+	for i, row := range rows {
+		sections[i] = by(row, roots)
 	}
-	if hasErrors {
-		header = append(header, "Error")
+
+	sort.Stable(sectionSorter{rows: rows, sections: sections})
+
+	return sections
+}
+
+// sectionSorter sorts rows by their section name, moving the names along with them
+type sectionSorter struct {
+	rows     []rowItem
+	sections []string
+}
+
+func (s sectionSorter) Len() int { return len(s.rows) }
+
+func (s sectionSorter) Less(i, j int) bool {
+	return strings.ToLower(s.sections[i]) < strings.ToLower(s.sections[j])
+}
+
+func (s sectionSorter) Swap(i, j int) {
+	s.rows[i], s.rows[j] = s.rows[j], s.rows[i]
+	s.sections[i], s.sections[j] = s.sections[j], s.sections[i]
+}
+
+func outputTable(rows []rowItem, roots []string) {
+
+	sortRows(rows)
+	sections := groupRows(rows, roots)
+
+	columns := tableColumnNames(rows)
+
+	header := table.Row{}
+	for _, name := range columns {
+		header = append(header, tableColumns[name].header)
 	}
 
 	tab := table.NewWriter()
@@ -306,47 +1130,25 @@ func outputTable(rows []rowItem, baseDir string) {
 	tab.SetStyle(table.StyleRounded)
 
 	hidden := 0
+	section := ""
 
-	for _, row := range rows {
+	for i, row := range rows {
 
 		if row.show() {
 
-			// Format path
-			if viper.GetBool(fShort) {
-				row.path = strings.TrimPrefix(row.path, baseDir)
-			}
-
-			// Format branch
-			if row.isDetached() {
-				row.branch = fmt.Sprintf("(detached at %s)", row.branch[:7])
-			} else if len(row.branch) > 30 {
-				row.branch = row.branch[:30] + "…"
-			}
-
-			if !row.isMain() {
-				row.branch = color.RedString(row.branch)
-			}
-
-			tr := table.Row{row.path, row.branch, row.changedFiles}
-
-			if viper.GetBool(fPull) {
-
-				var action = ""
-				if row.updated {
-					action = color.GreenString("Updated")
-				} else if !row.isDirty() {
-					action = "Pulled"
+			// Start a new section when the group changes
+			if sections != nil && (tab.Length() == 0 || sections[i] != section) {
+				if tab.Length() > 0 {
+					tab.AppendSeparator()
 				}
-
-				tr = append(tr, action)
+				section = sections[i]
+				tab.AppendRow(table.Row{color.New(color.Bold).Sprint(section)})
+				tab.AppendSeparator()
 			}
 
-			if hasErrors {
-				if row.error != nil {
-					tr = append(tr, row.error.Error())
-				} else {
-					tr = append(tr, "")
-				}
+			tr := table.Row{}
+			for _, name := range columns {
+				tr = append(tr, tableColumns[name].value(row, roots))
 			}
 
 			tab.AppendRow(tr)
@@ -361,7 +1163,66 @@ func outputTable(rows []rowItem, baseDir string) {
 		tab.Render()
 	}
 
-	if hidden > 0 {
+	if hidden > 0 && filteringByState() {
+		log.Println(color.BlueString(fmt.Sprintf("%d repos hidden by --only, --hide or --stale", hidden)))
+	} else if hidden > 0 {
 		log.Println(color.BlueString(fmt.Sprintf("%d repos with nothing to report, use --all to show them", hidden)))
 	}
 }
+
+func outputChangesJSON(changes []rowChange, ndjson bool) {
+
+	enc := json.NewEncoder(os.Stdout)
+
+	if ndjson {
+		for _, c := range changes {
+			if err := enc.Encode(c); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+		return
+	}
+
+	if changes == nil {
+		changes = []rowChange{}
+	}
+
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(changes); err != nil {
+		log.Println(err)
+	}
+}
+
+func outputJSON(rows []rowItem, roots []string, ndjson bool) {
+
+	sortRows(rows)
+
+	// Scripts get every repo, not just the ones with something to report
+	views := make([]rowView, 0, len(rows))
+	for _, row := range rows {
+		if row.matchesStateFilters() {
+			if viper.GetBool(fShort) {
+				row.path = trimRoot(row.path, roots)
+			}
+			views = append(views, row.view())
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+
+	if ndjson {
+		for _, v := range views {
+			if err := enc.Encode(v); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+		return
+	}
+
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(views); err != nil {
+		log.Println(err)
+	}
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -70,6 +77,61 @@ func TestFilterReposByFilterFlag(t *testing.T) {
 			filter:   " bar , baz ",
 			expected: []string{"/work/bar", "/work/bazqux"},
 		},
+		{
+			name:     "glob on basename (glob:ba*)",
+			filter:   "glob:ba*",
+			expected: []string{"/work/bar", "/work/bazqux"},
+		},
+		{
+			name:     "glob must match the whole basename (glob:work)",
+			filter:   "glob:work",
+			expected: []string{},
+		},
+		{
+			name:     "glob with a slash matches trailing segments (glob:WORK/ba?)",
+			filter:   "glob:WORK/ba?",
+			expected: []string{"/work/bar"},
+		},
+		{
+			name:     "absolute glob matches the full path (glob:/work/f*)",
+			filter:   "glob:/work/f*",
+			expected: []string{"/work/foo"},
+		},
+		{
+			name:     "negated glob (!glob:baz*)",
+			filter:   "!glob:baz*",
+			expected: []string{"/work/foo", "/work/bar"},
+		},
+		{
+			name:     "regex is anchored to the basename (re:ba)",
+			filter:   "re:ba",
+			expected: []string{},
+		},
+		{
+			name:     "regex on basename (re:ba[rz].*)",
+			filter:   "re:ba[rz].*",
+			expected: []string{"/work/bar", "/work/bazqux"},
+		},
+		{
+			name:     "regex with a slash matches the full path (re:/WORK/.*o)",
+			filter:   "re:/WORK/.*o",
+			expected: []string{"/work/foo"},
+		},
+		{
+			name:     "regex with a slash matches trailing segments (re:work/ba.)",
+			filter:   "re:work/ba.",
+			expected: []string{"/work/bar"},
+		},
+		{
+			name:     "commas inside a regex do not split it (re:fo{1,2}, bar)",
+			filter:   "re:fo{1,2}, bar",
+			expected: []string{"/work/foo", "/work/bar"},
+		},
+		{
+			name:     "mixed kinds (re:f.., !glob:*x, baz)",
+			filter:   "re:f.., !glob:*x, baz",
+			expected: []string{"/work/foo"},
+		},
 	}
 
 	for _, c := range cases {
@@ -93,6 +155,15 @@ func TestFilterReposByFilterFlag(t *testing.T) {
 	}
 }
 
+func TestParseFilterInvalid(t *testing.T) {
+
+	for _, filter := range []string{"re:(", "glob:[", "foo, !re:*"} {
+		if _, err := parseFilter(filter); err == nil {
+			t.Errorf("expected an error for %q", filter)
+		}
+	}
+}
+
 func TestLastLine(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -133,9 +204,11 @@ func TestLastLine(t *testing.T) {
 
 func TestIsMain(t *testing.T) {
 	tests := []struct {
-		name   string
-		branch string
-		want   bool
+		name          string
+		branch        string
+		mainBranches  []string
+		defaultBranch string
+		want          bool
 	}{
 		{
 			name:   "master branch",
@@ -157,11 +230,35 @@ func TestIsMain(t *testing.T) {
 			branch: "",
 			want:   false,
 		},
+		{
+			name:         "configured main branch",
+			branch:       "release",
+			mainBranches: []string{"release", "production"},
+			want:         true,
+		},
+		{
+			name:         "default name not in configured list",
+			branch:       "master",
+			mainBranches: []string{"release"},
+			want:         false,
+		},
+		{
+			name:          "detected default branch",
+			branch:        "production",
+			defaultBranch: "production",
+			want:          true,
+		},
+		{
+			name:          "off detected default branch",
+			branch:        "main",
+			defaultBranch: "production",
+			want:          false,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			r := rowItem{branch: tt.branch}
+			r := rowItem{branch: tt.branch, mainBranches: tt.mainBranches, defaultBranch: tt.defaultBranch}
 			if got := r.isMain(); got != tt.want {
 				t.Errorf("rowItem.isMain() = %v, want %v", got, tt.want)
 			}
@@ -253,6 +350,24 @@ func TestShow(t *testing.T) {
 			all:  false,
 			want: true,
 		},
+		{
+			name: "clean main branch with unpushed commits",
+			row: rowItem{
+				branch: "main",
+				ahead:  2,
+			},
+			all:  false,
+			want: true,
+		},
+		{
+			name: "clean main branch behind upstream",
+			row: rowItem{
+				branch: "main",
+				behind: 2,
+			},
+			all:  false,
+			want: false,
+		},
 		{
 			name: "clean main branch with updates",
 			row: rowItem{
@@ -278,7 +393,7 @@ func TestShow(t *testing.T) {
 	}
 }
 
-func TestScanAllDirs(t *testing.T) {
+func TestScanDirs(t *testing.T) {
 	t.Cleanup(func() { viper.Reset() })
 
 	// Create a temp directory structure with nested git repos
@@ -302,7 +417,10 @@ func TestScanAllDirs(t *testing.T) {
 
 	viper.Set(fMaxdepth, 2)
 
-	repos := scanAllDirs(tmpDir, 1)
+	var repos []repoItem
+	for r := range scanDirs([]string{tmpDir}, 1) {
+		repos = append(repos, r)
+	}
 
 	paths := make(map[string]bool)
 	for _, r := range repos {
@@ -323,10 +441,40 @@ func TestScanAllDirs(t *testing.T) {
 	}
 }
 
-func TestScanAllDirsInvalidDir(t *testing.T) {
-	repos := scanAllDirs("/nonexistent/path/that/does/not/exist", 1)
-	if len(repos) != 0 {
-		t.Errorf("expected 0 repos for invalid dir, got %d", len(repos))
+func TestScanDirsExclude(t *testing.T) {
+	t.Cleanup(func() { viper.Reset() })
+
+	tmpDir := t.TempDir()
+
+	for _, dir := range []string{"keep", "node_modules/dep", "org/vendor/lib", "org/build-out/gen", "org/app", "org/old"} {
+		os.MkdirAll(filepath.Join(tmpDir, dir, ".git"), 0o755)
+	}
+
+	// Applies to org and everything below it
+	os.WriteFile(filepath.Join(tmpDir, "org", ignoreFile), []byte("# generated\nbuild-*\n\nold/\n"), 0o644)
+
+	viper.Set(fMaxdepth, 3)
+	viper.Set(fExclude, []string{"node_modules,org/vendor"})
+
+	var got []string
+	for r := range scanDirs([]string{tmpDir}, 1) {
+		got = append(got, strings.TrimPrefix(r.path, tmpDir))
+	}
+	slices.Sort(got)
+
+	want := []string{"/keep", "/org/app"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	if !isExcluded("/code/org/vendor", []string{"org/vendor"}) || isExcluded("/code/vendor", []string{"org/vendor"}) {
+		t.Error("expected patterns with a slash to match the end of the path")
+	}
+}
+
+func TestScanDirsInvalidDir(t *testing.T) {
+	for r := range scanDirs([]string{"/nonexistent/path/that/does/not/exist"}, 1) {
+		t.Errorf("expected no repos for invalid dir, got %s", r.path)
 	}
 }
 
@@ -389,7 +537,7 @@ func TestGitPullEmptyRemote(t *testing.T) {
 	runGit(t, tmp, "init", "--bare", bare)
 	runGit(t, tmp, "clone", bare, clone)
 
-	updated, err := gitPull(rowItem{path: clone})
+	updated, err := gitPull(rowItem{path: clone}, "")
 	if err != nil {
 		t.Fatalf("expected no error pulling a clone of an empty remote, got: %v", err)
 	}
@@ -418,7 +566,7 @@ func TestGitPullDeletedRemoteBranch(t *testing.T) {
 	runGit(t, bare, "symbolic-ref", "HEAD", "refs/heads/gone")
 	runGit(t, bare, "branch", "-D", branch)
 
-	_, err = gitPull(rowItem{path: clone})
+	_, err = gitPull(rowItem{path: clone}, "")
 	if err == nil {
 		t.Fatal("expected an error pulling when the remote branch was deleted")
 	}
@@ -436,8 +584,8 @@ func TestGitDiff(t *testing.T) {
 	if err != nil {
 		t.Fatalf("gitDiff on clean repo: %v", err)
 	}
-	if diff != "" {
-		t.Errorf("expected empty diff on clean repo, got %q", diff)
+	if diff != (diffCounts{}) {
+		t.Errorf("expected empty diff on clean repo, got %+v", diff)
 	}
 
 	// Modify a file
@@ -447,8 +595,8 @@ func TestGitDiff(t *testing.T) {
 	if err != nil {
 		t.Fatalf("gitDiff on dirty repo: %v", err)
 	}
-	if diff == "" {
-		t.Error("expected non-empty diff on dirty repo")
+	if diff.modified != 1 {
+		t.Errorf("expected 1 modified file on dirty repo, got %+v", diff)
 	}
 }
 
@@ -488,3 +636,1566 @@ func TestGitBranchDetachedHead(t *testing.T) {
 		t.Errorf("expected 40-char commit hash for detached HEAD, got %q (len=%d)", branch, len(branch))
 	}
 }
+
+func TestGitAheadBehind(t *testing.T) {
+
+	src := initTestRepo(t)
+
+	tmp := t.TempDir()
+	bare := filepath.Join(tmp, "bare.git")
+	clone := filepath.Join(tmp, "clone")
+
+	runGit(t, tmp, "clone", "--bare", src, bare)
+	runGit(t, tmp, "clone", bare, clone)
+	runGit(t, clone, "config", "user.email", "test@test.com")
+	runGit(t, clone, "config", "user.name", "Test")
+
+	ahead, behind, err := gitAheadBehind(clone)
+	if err != nil {
+		t.Fatalf("gitAheadBehind: %v", err)
+	}
+	if ahead != 0 || behind != 0 {
+		t.Errorf("expected 0/0 on a fresh clone, got %d/%d", ahead, behind)
+	}
+
+	// One local commit, one remote commit
+	runGit(t, clone, "commit", "--allow-empty", "-m", "local")
+	runGit(t, src, "commit", "--allow-empty", "-m", "remote")
+	runGit(t, src, "push", bare, "HEAD")
+	runGit(t, clone, "fetch")
+
+	ahead, behind, err = gitAheadBehind(clone)
+	if err != nil {
+		t.Fatalf("gitAheadBehind: %v", err)
+	}
+	if ahead != 1 || behind != 1 {
+		t.Errorf("expected 1/1, got %d/%d", ahead, behind)
+	}
+}
+
+func TestGitAheadBehindNoUpstream(t *testing.T) {
+
+	dir := initTestRepo(t)
+
+	ahead, behind, err := gitAheadBehind(dir)
+	if err != nil {
+		t.Fatalf("expected no error without an upstream, got: %v", err)
+	}
+	if ahead != 0 || behind != 0 {
+		t.Errorf("expected 0/0 without an upstream, got %d/%d", ahead, behind)
+	}
+}
+
+func TestRowView(t *testing.T) {
+
+	row := rowItem{
+		path:          "/work/foo",
+		worktreeOf:    "/work/main",
+		branch:        "main",
+		changes:       diffCounts{added: 1, modified: 2, deleted: 3},
+		ahead:         4,
+		behind:        5,
+		updated:       true,
+		stashConflict: true,
+		error:         errors.New("boom"),
+	}
+
+	b, err := json.Marshal(row.view())
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+
+	want := `{"path":"/work/foo","worktree_of":"/work/main","branch":"main","added":1,"modified":2,"deleted":3,"staged":0,"unstaged":0,"untracked":0,"renamed":0,"conflicted":0,"stashes":0,"ahead":4,"behind":5,"updated":true,"stash_conflict":true,"fetched":0,"error":"boom"}`
+	if string(b) != want {
+		t.Errorf("expected %s\n     got %s", want, b)
+	}
+}
+
+func TestGitFetch(t *testing.T) {
+
+	src := initTestRepo(t)
+
+	tmp := t.TempDir()
+	bare := filepath.Join(tmp, "bare.git")
+	clone := filepath.Join(tmp, "clone")
+
+	runGit(t, tmp, "clone", "--bare", src, bare)
+	runGit(t, bare, "branch", "feature")
+	runGit(t, tmp, "clone", bare, clone)
+
+	// Dirty the clone, fetch should not care
+	os.WriteFile(filepath.Join(clone, "file.txt"), []byte("modified"), 0o644)
+
+	// Two new upstream commits and a deleted remote branch
+	runGit(t, src, "commit", "--allow-empty", "-m", "one")
+	runGit(t, src, "commit", "--allow-empty", "-m", "two")
+	runGit(t, src, "push", bare, "HEAD")
+	runGit(t, bare, "branch", "-D", "feature")
+
+	fetched, pruned, err := gitFetch(clone)
+	if err != nil {
+		t.Fatalf("gitFetch: %v", err)
+	}
+	if fetched != 2 {
+		t.Errorf("expected 2 fetched commits, got %d", fetched)
+	}
+	if !reflect.DeepEqual(pruned, []string{"origin/feature"}) {
+		t.Errorf("expected [origin/feature] pruned, got %v", pruned)
+	}
+
+	// Nothing new the second time
+	fetched, pruned, err = gitFetch(clone)
+	if err != nil {
+		t.Fatalf("gitFetch: %v", err)
+	}
+	if fetched != 0 || len(pruned) != 0 {
+		t.Errorf("expected nothing on second fetch, got %d fetched, %v pruned", fetched, pruned)
+	}
+
+	// The checked out branch's upstream being pruned is reported, not an error
+	runGit(t, clone, "checkout", "-q", "-b", "feat")
+	runGit(t, clone, "push", "-q", "-u", "origin", "feat")
+	runGit(t, bare, "branch", "-D", "feat")
+
+	fetched, pruned, err = gitFetch(clone)
+	if err != nil {
+		t.Fatalf("gitFetch with a pruned upstream: %v", err)
+	}
+	if fetched != 0 || !reflect.DeepEqual(pruned, []string{"origin/feat"}) {
+		t.Errorf("expected [origin/feat] pruned and nothing fetched, got %d fetched, %v pruned", fetched, pruned)
+	}
+	if ahead, behind, err := gitAheadBehind(clone); err != nil || ahead != 0 || behind != 0 {
+		t.Errorf("expected 0/0 with no upstream, got %d/%d, %v", ahead, behind, err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+
+	t.Cleanup(func() { viper.Reset() })
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte(`
+dir: /code
+maxdepth: 3
+profiles:
+  work:
+    dir: /work
+    filter: "!archive"
+    pull: true
+`), 0o644)
+
+	viper.Set(fConfig, path)
+	viper.Set(fProfile, "work")
+
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	if got := viper.GetString(fDir); got != "/work" {
+		t.Errorf("expected profile dir /work, got %q", got)
+	}
+	if got := viper.GetString(fFilter); got != "!archive" {
+		t.Errorf("expected profile filter !archive, got %q", got)
+	}
+	if got := viper.GetBool(fPull); !got {
+		t.Error("expected profile pull to be true")
+	}
+	if got := viper.GetInt(fMaxdepth); got != 3 {
+		t.Errorf("expected top level maxdepth 3, got %d", got)
+	}
+}
+
+func TestLoadConfigMissingProfile(t *testing.T) {
+
+	t.Cleanup(func() { viper.Reset() })
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte("dir: /code\n"), 0o644)
+
+	viper.Set(fConfig, path)
+	viper.Set(fProfile, "missing")
+
+	if err := loadConfig(); err == nil {
+		t.Fatal("expected an error for a missing profile")
+	}
+}
+
+func TestLoadConfigMissingExplicitFile(t *testing.T) {
+
+	t.Cleanup(func() { viper.Reset() })
+
+	viper.Set(fConfig, filepath.Join(t.TempDir(), "nope.yaml"))
+
+	if err := loadConfig(); err == nil {
+		t.Fatal("expected an error for a missing --config file")
+	}
+}
+
+func TestMainBranches(t *testing.T) {
+
+	t.Cleanup(func() { viper.Reset() })
+
+	if got := mainBranches("/work/foo"); !reflect.DeepEqual(got, defaultMainBranches) {
+		t.Errorf("expected defaults, got %v", got)
+	}
+
+	viper.Set(fMainBranches, []string{"main,release"})
+	if got := mainBranches("/work/foo"); !reflect.DeepEqual(got, []string{"main", "release"}) {
+		t.Errorf("expected global list, got %v", got)
+	}
+
+	viper.Set("repos", []map[string]any{
+		{"path": "/work/foo/", "main-branches": []string{"production"}},
+	})
+	if got := mainBranches("/work/foo"); !reflect.DeepEqual(got, []string{"production"}) {
+		t.Errorf("expected per repo list, got %v", got)
+	}
+	if got := mainBranches("/work/bar"); !reflect.DeepEqual(got, []string{"main", "release"}) {
+		t.Errorf("expected global list for other repos, got %v", got)
+	}
+}
+
+func TestGitDefaultBranch(t *testing.T) {
+
+	src := initTestRepo(t)
+
+	tmp := t.TempDir()
+	bare := filepath.Join(tmp, "bare.git")
+	clone := filepath.Join(tmp, "clone")
+
+	runGit(t, src, "branch", "-m", "production")
+	runGit(t, tmp, "clone", "--bare", src, bare)
+	runGit(t, tmp, "clone", bare, clone)
+
+	branch, err := gitDefaultBranch(clone)
+	if err != nil {
+		t.Fatalf("gitDefaultBranch: %v", err)
+	}
+	if branch != "production" {
+		t.Errorf("expected production, got %q", branch)
+	}
+
+	// No remote at all
+	branch, err = gitDefaultBranch(src)
+	if err != nil {
+		t.Fatalf("gitDefaultBranch without a remote: %v", err)
+	}
+	if branch != "" {
+		t.Errorf("expected no default branch without a remote, got %q", branch)
+	}
+}
+
+func TestExecRepos(t *testing.T) {
+
+	repo1 := initTestRepo(t)
+	repo2 := initTestRepo(t)
+
+	results := execRepos([]repoItem{{path: repo1}, {path: repo2}}, []string{"git", "rev-parse", "--is-inside-work-tree"})
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	for _, r := range results {
+		if r.failed() {
+			t.Errorf("expected %s to succeed, got exit %d: %s", r.path, r.exitCode, r.stderr)
+		}
+		if string(lastLine(r.stdout)) != "true" {
+			t.Errorf("expected stdout true, got %q", r.stdout)
+		}
+	}
+}
+
+func TestExecRepoFailure(t *testing.T) {
+
+	dir := initTestRepo(t)
+
+	result := execRepo(dir, []string{"git", "checkout", "does-not-exist"})
+	if !result.failed() {
+		t.Fatal("expected the command to fail")
+	}
+	if result.exitCode == 0 {
+		t.Error("expected a non-zero exit code")
+	}
+	if len(result.stderr) == 0 {
+		t.Error("expected stderr to be captured")
+	}
+
+	result = execRepo(dir, []string{"gitstatus-command-that-does-not-exist"})
+	if result.error == nil {
+		t.Error("expected an error for a missing command")
+	}
+}
+
+func TestGitOperation(t *testing.T) {
+
+	dir := initTestRepo(t)
+
+	op, err := gitOperation(dir)
+	if err != nil {
+		t.Fatalf("gitOperation: %v", err)
+	}
+	if op != "" {
+		t.Errorf("expected no operation on a clean repo, got %q", op)
+	}
+
+	// Conflicting change on a branch, then merge it
+	runGit(t, dir, "checkout", "-b", "other")
+	os.WriteFile(filepath.Join(dir, "file.txt"), []byte("other"), 0o644)
+	runGit(t, dir, "commit", "-am", "other")
+	runGit(t, dir, "checkout", "-")
+	os.WriteFile(filepath.Join(dir, "file.txt"), []byte("main"), 0o644)
+	runGit(t, dir, "commit", "-am", "main")
+
+	_ = exec.Command("git", "-C", dir, "merge", "other").Run()
+
+	op, err = gitOperation(dir)
+	if err != nil {
+		t.Fatalf("gitOperation: %v", err)
+	}
+	if op != "MERGING" {
+		t.Errorf("expected MERGING, got %q", op)
+	}
+
+	_, err = gitPull(rowItem{path: dir, operation: op}, "")
+	if err == nil || err.Error() != "Not pulling, repo is merging" {
+		t.Errorf("expected pull to be refused, got: %v", err)
+	}
+}
+
+func TestGitStashCount(t *testing.T) {
+
+	dir := initTestRepo(t)
+
+	count, err := gitStashCount(dir)
+	if err != nil {
+		t.Fatalf("gitStashCount: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("expected 0 stashes, got %d", count)
+	}
+
+	for _, content := range []string{"one", "two"} {
+		os.WriteFile(filepath.Join(dir, "file.txt"), []byte(content), 0o644)
+		runGit(t, dir, "stash")
+	}
+
+	count, err = gitStashCount(dir)
+	if err != nil {
+		t.Fatalf("gitStashCount: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 stashes, got %d", count)
+	}
+}
+
+func TestStreamReposWorktrees(t *testing.T) {
+
+	t.Cleanup(func() { viper.Reset() })
+
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mainRepo := filepath.Join(base, "main")
+	inside := filepath.Join(base, "wt")
+	outside := filepath.Join(t.TempDir(), "outside")
+
+	runGit(t, base, "init", mainRepo)
+	runGit(t, mainRepo, "-c", "user.email=test@test.com", "-c", "user.name=Test", "commit", "--allow-empty", "-m", "initial")
+	runGit(t, mainRepo, "worktree", "add", "-b", "inside", inside)
+	runGit(t, mainRepo, "worktree", "add", "-b", "outside", outside)
+
+	viper.Set(fMaxdepth, 2)
+
+	// The worktree inside base is found by the scan and from the main repo, but only sent once
+	var total int
+	got := map[string]string{}
+	for r := range streamRepos([]string{base}, &total) {
+		got[filepath.Base(r.path)] = r.worktreeOf
+	}
+
+	want := map[string]string{"main": "", "wt": mainRepo, "outside": mainRepo}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if total != 3 {
+		t.Errorf("expected 3 repos, got %d", total)
+	}
+
+	if gitDir := resolveGitDir(inside); filepath.Dir(gitDir) != filepath.Join(mainRepo, ".git", "worktrees") {
+		t.Errorf("expected worktree git dir under main repo, got %s", gitDir)
+	}
+}
+
+func TestSortRowsGroupsWorktrees(t *testing.T) {
+
+	rows := []rowItem{
+		{path: "/work/b"},
+		{path: "/work/z-wt", worktreeOf: "/work/a"},
+		{path: "/work/a"},
+	}
+
+	sortRows(rows)
+
+	var got []string
+	for _, r := range rows {
+		got = append(got, r.path)
+	}
+
+	want := []string{"/work/a", "/work/z-wt", "/work/b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+// fakeResponse is what the fake backend returns for a git command
+type fakeResponse struct {
+	stdout   string
+	stderr   string
+	exitCode int
+	err      error
+}
+
+// fakeBackend is a scripted git backend, keyed on the space separated args
+type fakeBackend struct {
+	mu        sync.Mutex
+	responses map[string]fakeResponse
+	calls     []string
+}
+
+func (f *fakeBackend) run(_ context.Context, _ string, args ...string) ([]byte, []byte, error) {
+
+	key := strings.Join(args, " ")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, key)
+
+	resp, ok := f.responses[key]
+	if !ok {
+		return nil, nil, errors.New("unexpected git call: " + key)
+	}
+	if resp.err != nil {
+		return nil, nil, resp.err
+	}
+	if resp.exitCode != 0 {
+		return []byte(resp.stdout), []byte(resp.stderr), &gitError{exitCode: resp.exitCode, stderr: resp.stderr}
+	}
+	return []byte(resp.stdout), []byte(resp.stderr), nil
+}
+
+// useFakeBackend swaps in a scripted backend for the rest of the test
+func useFakeBackend(t *testing.T, responses map[string]fakeResponse) *fakeBackend {
+
+	t.Helper()
+
+	fake := &fakeBackend{responses: responses}
+
+	old := backend
+	backend = fake
+	t.Cleanup(func() { backend = old })
+
+	return fake
+}
+
+func TestFakeBackendTimeout(t *testing.T) {
+
+	useFakeBackend(t, map[string]fakeResponse{
+		"status --porcelain=v2": {err: context.DeadlineExceeded},
+	})
+
+	_, err := gitDiff("/work/foo")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a timeout error, got: %v", err)
+	}
+}
+
+func TestFakeBackendPullAuthFailure(t *testing.T) {
+
+	useFakeBackend(t, map[string]fakeResponse{
+		"pull": {exitCode: 128, stderr: "fatal: Authentication failed for 'https://example.com/repo.git/'"},
+	})
+
+	_, err := gitPull(rowItem{path: "/work/foo"}, "")
+	if err == nil || !strings.Contains(err.Error(), "Authentication failed") {
+		t.Errorf("expected an auth error, got: %v", err)
+	}
+}
+
+func TestFakeBackendPullEmptyRemote(t *testing.T) {
+
+	fake := useFakeBackend(t, map[string]fakeResponse{
+		"pull":                       {exitCode: 1, stderr: "Your configuration specifies to merge with the ref 'refs/heads/main'\nfrom the remote, but no such ref was fetched."},
+		"rev-parse --verify -q HEAD": {exitCode: 1},
+	})
+
+	updated, err := gitPull(rowItem{path: "/work/foo"}, "")
+	if err != nil || updated {
+		t.Errorf("expected a quiet no-op for an empty remote, got updated=%v err=%v", updated, err)
+	}
+	if want := []string{"pull", "rev-parse --verify -q HEAD"}; !reflect.DeepEqual(fake.calls, want) {
+		t.Errorf("expected calls %v, got %v", want, fake.calls)
+	}
+}
+
+func TestFakeBackendPullUpdated(t *testing.T) {
+
+	useFakeBackend(t, map[string]fakeResponse{
+		"pull": {stdout: "Updating abc..def\nFast-forward\n file.txt | 2 +-\n 1 file changed, 1 insertion(+), 1 deletion(-)\n"},
+	})
+
+	updated, err := gitPull(rowItem{path: "/work/foo"}, "")
+	if err != nil {
+		t.Fatalf("gitPull: %v", err)
+	}
+	if !updated {
+		t.Error("expected updated=true")
+	}
+}
+
+func TestFakeBackendFetchFailure(t *testing.T) {
+
+	useFakeBackend(t, map[string]fakeResponse{
+		"rev-parse -q --verify @{upstream}": {stdout: "abc\n"},
+		"fetch --prune":                     {exitCode: 128, stderr: "fatal: unable to access 'https://example.com/': Could not resolve host"},
+	})
+
+	_, _, err := gitFetch("/work/foo")
+	if err == nil || !strings.Contains(err.Error(), "Could not resolve host") {
+		t.Errorf("expected a network error, got: %v", err)
+	}
+}
+
+func TestFakeBackendAheadBehindBadOutput(t *testing.T) {
+
+	useFakeBackend(t, map[string]fakeResponse{
+		"rev-parse --abbrev-ref @{upstream}":               {stdout: "origin/main\n"},
+		"rev-list --left-right --count HEAD...@{upstream}": {stdout: "garbage\n"},
+	})
+
+	if _, _, err := gitAheadBehind("/work/foo"); err == nil {
+		t.Error("expected an error for unparseable rev-list output")
+	}
+}
+
+// cloneTestRepo makes a bare remote from src and returns a clone of it.
+func cloneTestRepo(t *testing.T, src string) (bare string, clone string) {
+
+	t.Helper()
+
+	tmp := t.TempDir()
+	bare = filepath.Join(tmp, "bare.git")
+	clone = filepath.Join(tmp, "clone")
+
+	runGit(t, tmp, "clone", "--bare", src, bare)
+	runGit(t, tmp, "clone", bare, clone)
+	runGit(t, clone, "config", "user.email", "test@test.com")
+	runGit(t, clone, "config", "user.name", "Test")
+
+	return bare, clone
+}
+
+func TestGitPullFFOnlyDiverged(t *testing.T) {
+
+	src := initTestRepo(t)
+	bare, clone := cloneTestRepo(t, src)
+
+	runGit(t, clone, "commit", "--allow-empty", "-m", "local")
+	runGit(t, src, "commit", "--allow-empty", "-m", "remote")
+	runGit(t, src, "push", bare, "HEAD")
+
+	if _, err := gitPull(rowItem{path: clone}, "ff-only"); err == nil {
+		t.Fatal("expected ff-only pull to fail on diverged branches")
+	}
+
+	updated, err := gitPull(rowItem{path: clone}, "rebase")
+	if err != nil {
+		t.Fatalf("expected rebase pull to succeed, got: %v", err)
+	}
+	if ahead, behind, _ := gitAheadBehind(clone); ahead != 1 || behind != 0 {
+		t.Errorf("expected 1/0 after rebase, got %d/%d (updated=%v)", ahead, behind, updated)
+	}
+}
+
+func TestGitPullAutostash(t *testing.T) {
+
+	src := initTestRepo(t)
+	bare, clone := cloneTestRepo(t, src)
+
+	os.WriteFile(filepath.Join(src, "other.txt"), []byte("remote"), 0o644)
+	runGit(t, src, "add", ".")
+	runGit(t, src, "commit", "-m", "remote")
+	runGit(t, src, "push", bare, "HEAD")
+
+	os.WriteFile(filepath.Join(clone, "file.txt"), []byte("local"), 0o644)
+
+	row := rowItem{path: clone, changedFiles: "~1"}
+	updated, conflicted, err := gitPullAutostash(row, "ff-only")
+	if err != nil {
+		t.Fatalf("gitPullAutostash: %v", err)
+	}
+	if !updated || conflicted {
+		t.Errorf("expected updated without conflict, got updated=%v conflicted=%v", updated, conflicted)
+	}
+
+	if b, _ := os.ReadFile(filepath.Join(clone, "file.txt")); string(b) != "local" {
+		t.Errorf("expected local changes to be re-applied, got %q", b)
+	}
+	if count, _ := gitStashCount(clone); count != 0 {
+		t.Errorf("expected the stash to be dropped, got %d entries", count)
+	}
+}
+
+func TestGitPullAutostashConflict(t *testing.T) {
+
+	src := initTestRepo(t)
+	bare, clone := cloneTestRepo(t, src)
+
+	os.WriteFile(filepath.Join(src, "file.txt"), []byte("remote"), 0o644)
+	runGit(t, src, "commit", "-am", "remote")
+	runGit(t, src, "push", bare, "HEAD")
+
+	os.WriteFile(filepath.Join(clone, "file.txt"), []byte("local"), 0o644)
+
+	row := rowItem{path: clone, changedFiles: "~1"}
+	updated, conflicted, err := gitPullAutostash(row, "")
+	if err != nil {
+		t.Fatalf("gitPullAutostash: %v", err)
+	}
+	if !updated || !conflicted {
+		t.Errorf("expected updated with a conflict, got updated=%v conflicted=%v", updated, conflicted)
+	}
+	if count, _ := gitStashCount(clone); count != 1 {
+		t.Errorf("expected changes to be kept in the stash, got %d entries", count)
+	}
+}
+
+// popFailBackend runs git for real, except for stash pop
+type popFailBackend struct {
+	execBackend
+}
+
+func (b popFailBackend) run(ctx context.Context, repoPath string, args ...string) ([]byte, []byte, error) {
+	if strings.Join(args, " ") == "stash pop" {
+		return nil, nil, context.DeadlineExceeded
+	}
+	return b.execBackend.run(ctx, repoPath, args...)
+}
+
+func TestGitPullAutostashPopFails(t *testing.T) {
+
+	src := initTestRepo(t)
+	_, clone := cloneTestRepo(t, src)
+
+	os.WriteFile(filepath.Join(clone, "file.txt"), []byte("local"), 0o644)
+
+	old := backend
+	backend = popFailBackend{}
+	t.Cleanup(func() { backend = old })
+
+	row := rowItem{path: clone, changedFiles: "~1"}
+	_, conflicted, err := gitPullAutostash(row, "ff-only")
+	if err == nil || !strings.Contains(err.Error(), "left in the stash") {
+		t.Errorf("expected an error saying the changes are in the stash, got %v", err)
+	}
+	if !conflicted {
+		t.Error("expected the row to be flagged as a stash conflict")
+	}
+	if count, _ := gitStashCount(clone); count != 1 {
+		t.Errorf("expected the changes to be kept in the stash, got %d entries", count)
+	}
+}
+
+func TestGitPullAutostashNothingStashed(t *testing.T) {
+
+	src := initTestRepo(t)
+	bare, clone := cloneTestRepo(t, src)
+
+	os.WriteFile(filepath.Join(src, "other.txt"), []byte("remote"), 0o644)
+	runGit(t, src, "add", ".")
+	runGit(t, src, "commit", "-m", "remote")
+	runGit(t, src, "push", bare, "HEAD")
+
+	os.WriteFile(filepath.Join(clone, "file.txt"), []byte("precious"), 0o644)
+	runGit(t, clone, "stash", "push", "-m", "my precious stash")
+
+	// Counted as dirty, but with nothing stash can save, like a repo with only submodule changes
+	row := rowItem{path: clone, changedFiles: "~1"}
+	updated, conflicted, err := gitPullAutostash(row, "ff-only")
+	if err != nil {
+		t.Fatalf("gitPullAutostash: %v", err)
+	}
+	if !updated || conflicted {
+		t.Errorf("expected updated without conflict, got updated=%v conflicted=%v", updated, conflicted)
+	}
+
+	if count, _ := gitStashCount(clone); count != 1 {
+		t.Errorf("expected the existing stash to be kept, got %d entries", count)
+	}
+	if b, _ := os.ReadFile(filepath.Join(clone, "file.txt")); string(b) == "precious" {
+		t.Error("expected the existing stash not to be applied")
+	}
+}
+
+func TestTUIApplyAndNavigate(t *testing.T) {
+
+	ui := newTUI([]repoItem{{path: "/work/b"}, {path: "/work/a"}}, []string{"/work"})
+
+	if ui.rows[0].path != "/work/a" || ui.rows[1].path != "/work/b" {
+		t.Fatalf("expected rows sorted by path, got %v, %v", ui.rows[0].path, ui.rows[1].path)
+	}
+
+	// Actions are ignored until the row has loaded
+	ui.handleKey("p")
+	if len(ui.busy) != 0 {
+		t.Error("expected no action on a row that has not loaded")
+	}
+
+	ui.busy["/work/b"] = "pulling"
+	ui.apply(tuiUpdate{row: rowItem{path: "/work/b", branch: "main"}, message: "Pulled /work/b"})
+
+	if ui.rows[1].branch != "main" {
+		t.Errorf("expected row to be replaced, got %+v", ui.rows[1])
+	}
+	if !ui.loaded["/work/b"] || ui.busy["/work/b"] != "" {
+		t.Error("expected row to be loaded and no longer busy")
+	}
+	if ui.message != "Pulled /work/b" {
+		t.Errorf("expected message to be set, got %q", ui.message)
+	}
+
+	ui.handleKey("\x1b[B")
+	ui.handleKey("j")
+	if ui.selected != 1 {
+		t.Errorf("expected selection to stop at the last row, got %d", ui.selected)
+	}
+
+	ui.handleKey("k")
+	if ui.selected != 0 {
+		t.Errorf("expected selection to move up, got %d", ui.selected)
+	}
+
+	if !ui.handleKey("q") {
+		t.Error("expected q to quit")
+	}
+}
+
+func TestRepoWatcher(t *testing.T) {
+
+	dir := initTestRepo(t)
+	os.MkdirAll(filepath.Join(dir, "sub"), 0o755)
+
+	w, err := newRepoWatcher([]repoItem{{path: dir}})
+	if err != nil {
+		t.Fatalf("newRepoWatcher: %v", err)
+	}
+	defer w.watcher.Close()
+
+	for _, path := range []string{filepath.Join(dir, "sub", "new.txt"), filepath.Join(dir, ".git", "HEAD"), filepath.Join(dir, ".git", "refs", "heads", "main")} {
+		if got := w.repoFor(path); got != dir {
+			t.Errorf("expected %s to belong to %s, got %q", path, dir, got)
+		}
+	}
+	if got := w.repoFor("/somewhere/else"); got != "" {
+		t.Errorf("expected no repo for an unrelated path, got %q", got)
+	}
+
+	rows := map[string]rowItem{dir: readRepo(repoItem{path: dir}, false, false)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	changes := make(chan []rowItem, 10)
+	go w.run(ctx, rows, 50*time.Millisecond, func(changed []rowItem) {
+		changes <- changed
+	})
+
+	// Several writes should settle into a single refresh
+	for i := range 5 {
+		os.WriteFile(filepath.Join(dir, "sub", "new.txt"), []byte{byte(i)}, 0o644)
+	}
+
+	select {
+	case changed := <-changes:
+		if len(changed) != 1 || changed[0].path != dir || !changed[0].isDirty() {
+			t.Errorf("expected one dirty row, got %+v", changed)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for a change")
+	}
+
+	select {
+	case changed := <-changes:
+		t.Errorf("expected a single refresh, got another with %+v", changed)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestRepoWatcherExcludes(t *testing.T) {
+
+	dir := initTestRepo(t)
+	os.MkdirAll(filepath.Join(dir, "src"), 0o755)
+	os.MkdirAll(filepath.Join(dir, "node_modules", "left-pad"), 0o755)
+
+	w, err := newRepoWatcher([]repoItem{{path: dir, excludes: []string{"node_modules"}}})
+	if err != nil {
+		t.Fatalf("newRepoWatcher: %v", err)
+	}
+	defer w.watcher.Close()
+
+	if _, ok := w.dirs[filepath.Join(dir, "src")]; !ok {
+		t.Error("expected src to be watched")
+	}
+	for _, path := range []string{filepath.Join(dir, "node_modules"), filepath.Join(dir, "node_modules", "left-pad")} {
+		if _, ok := w.dirs[path]; ok {
+			t.Errorf("expected %s not to be watched", path)
+		}
+	}
+}
+
+func TestRepoCache(t *testing.T) {
+
+	dir := initTestRepo(t)
+	path := filepath.Join(t.TempDir(), "cache.json")
+
+	c := loadCache(path)
+	if _, ok := c.get(repoItem{path: dir}); ok {
+		t.Fatal("expected a miss on an empty cache")
+	}
+
+	row := readRepo(repoItem{path: dir}, false, false)
+	row.stashes = 2
+	c.put(row)
+
+	if err := c.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	c = loadCache(path)
+	cached, ok := c.get(repoItem{path: dir})
+	if !ok {
+		t.Fatal("expected a hit after saving")
+	}
+	if cached.branch != row.branch || cached.stashes != row.stashes {
+		t.Errorf("expected cached row to match, got %+v", cached)
+	}
+
+	// A new commit moves HEAD's ref and the index
+	os.WriteFile(filepath.Join(dir, "file.txt"), []byte("changed"), 0o644)
+	runGit(t, dir, "commit", "-am", "change")
+
+	if _, ok := c.get(repoItem{path: dir}); ok {
+		t.Error("expected a miss after a commit")
+	}
+
+	// Errors are never cached
+	c.put(rowItem{path: dir, error: errors.New("boom")})
+	if _, ok := c.get(repoItem{path: dir}); ok {
+		t.Error("expected rows with errors not to be cached")
+	}
+}
+
+func TestPullRepoCacheSeesEdits(t *testing.T) {
+
+	t.Cleanup(func() { statusCache = nil })
+	statusCache = loadCache(filepath.Join(t.TempDir(), "cache.json"))
+
+	dir := initTestRepo(t)
+
+	if row := pullRepo(repoItem{path: dir}); row.isDirty() {
+		t.Fatalf("expected a clean repo, got %q", row.changedFiles)
+	}
+	if _, ok := statusCache.get(repoItem{path: dir}); !ok {
+		t.Fatal("expected the repo to be cached")
+	}
+
+	// Editing a tracked file touches nothing in the fingerprint
+	os.WriteFile(filepath.Join(dir, "file.txt"), []byte("edited"), 0o644)
+
+	row := pullRepo(repoItem{path: dir})
+	if row.changes.modified != 1 {
+		t.Errorf("expected the edit to be seen through the cache, got %+v", row.changes)
+	}
+}
+
+func TestSnapshotDiff(t *testing.T) {
+
+	t.Cleanup(func() { viper.Reset() })
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+
+	snap, err := loadSnapshot(path)
+	if err != nil {
+		t.Fatalf("loadSnapshot on a missing file: %v", err)
+	}
+
+	first := []rowItem{
+		{path: "/work/same", branch: "main"},
+		{path: "/work/switched", branch: "main"},
+		{path: "/work/dirty", branch: "main"},
+		{path: "/work/deleted", branch: "main"},
+	}
+	if err = snap.update(first, nil).save(path); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	snap, err = loadSnapshot(path)
+	if err != nil {
+		t.Fatalf("loadSnapshot: %v", err)
+	}
+
+	second := []rowItem{
+		{path: "/work/same", branch: "main"},
+		{path: "/work/switched", branch: "feature"},
+		{path: "/work/dirty", branch: "main", changes: diffCounts{modified: 1}, ahead: 2},
+		{path: "/work/added", branch: "main"},
+	}
+
+	gone := snap.goneRepos(second, []string{"/work"})
+	if !reflect.DeepEqual(gone, []string{"/work/deleted"}) {
+		t.Fatalf("expected /work/deleted to be gone, got %v", gone)
+	}
+
+	changes := snap.diff(second, gone)
+
+	got := map[string]rowChange{}
+	for _, c := range changes {
+		got[c.Path] = c
+	}
+
+	if len(changes) != 4 {
+		t.Errorf("expected 4 changes, got %+v", changes)
+	}
+	if _, ok := got["/work/same"]; ok {
+		t.Error("expected unchanged repo to be left out")
+	}
+	if c := got["/work/switched"]; c.Fields["branch"] != (fieldChange{Before: "main", After: "feature"}) {
+		t.Errorf("expected branch change, got %+v", c)
+	}
+	if c := got["/work/dirty"]; c.Fields["sync"].After != "↑2" || c.Fields["changes"].Before != "" || c.Fields["changes"].After == "" {
+		t.Errorf("expected changes and sync to change, got %+v", c)
+	}
+	if got["/work/added"].Status != "new" || got["/work/deleted"].Status != "gone" {
+		t.Errorf("expected new and gone repos, got %+v", changes)
+	}
+
+	next := snap.update(second, gone)
+	if _, ok := next["/work/deleted"]; ok {
+		t.Error("expected gone repo to be dropped from the snapshot")
+	}
+	if next["/work/switched"].Branch != "feature" {
+		t.Error("expected snapshot to hold the latest rows")
+	}
+}
+
+func TestParsePorcelainV2(t *testing.T) {
+
+	out := []byte(`# branch.oid 1234567890123456789012345678901234567890
+# branch.head main
+1 M. N... 100644 100644 100644 abc abc staged.txt
+1 .M N... 100644 100644 100644 abc abc unstaged.txt
+1 MM N... 100644 100644 100644 abc abc both.txt
+1 A. N... 000000 100644 100644 000 abc new.txt
+1 .D N... 100644 100644 000000 abc abc gone.txt
+2 R. N... 100644 100644 100644 abc abc R100 renamed.txt	old.txt
+u UU N... 100644 100644 100644 100644 abc abc abc conflict.txt
+? untracked file.txt
+! ignored.txt
+`)
+
+	got := parsePorcelainV2(out)
+	want := diffCounts{
+		added:      1,
+		modified:   4,
+		deleted:    1,
+		staged:     4,
+		unstaged:   3,
+		untracked:  1,
+		renamed:    1,
+		conflicted: 1,
+	}
+
+	if got != want {
+		t.Errorf("expected %+v\n     got %+v", want, got)
+	}
+
+	// Untracked files are still in the summary, but not counted as additions
+	if got := parsePorcelainV2([]byte("? new.txt\n")); got.added != 0 || got.total() != 1 || !strings.Contains(got.String(), "+1") {
+		t.Errorf("expected one untracked file only, got %+v %q", got, got.String())
+	}
+}
+
+func TestGitDiffBreakdown(t *testing.T) {
+
+	dir := initTestRepo(t)
+
+	os.WriteFile(filepath.Join(dir, "other.txt"), []byte("other"), 0o644)
+	runGit(t, dir, "add", ".")
+	runGit(t, dir, "commit", "-m", "other")
+
+	runGit(t, dir, "mv", "other.txt", "renamed.txt")
+	os.WriteFile(filepath.Join(dir, "file.txt"), []byte("unstaged"), 0o644)
+	os.WriteFile(filepath.Join(dir, "untracked.txt"), []byte("untracked"), 0o644)
+
+	d, err := gitDiff(dir)
+	if err != nil {
+		t.Fatalf("gitDiff: %v", err)
+	}
+
+	if d.staged != 1 || d.renamed != 1 || d.unstaged != 1 || d.untracked != 1 || d.conflicted != 0 {
+		t.Errorf("unexpected breakdown %+v", d)
+	}
+}
+
+func TestGitDiffConflicts(t *testing.T) {
+
+	dir := initTestRepo(t)
+
+	runGit(t, dir, "checkout", "-b", "other")
+	os.WriteFile(filepath.Join(dir, "file.txt"), []byte("other"), 0o644)
+	os.WriteFile(filepath.Join(dir, "both.txt"), []byte("other"), 0o644)
+	runGit(t, dir, "add", ".")
+	runGit(t, dir, "commit", "-m", "other")
+	runGit(t, dir, "checkout", "-")
+	os.WriteFile(filepath.Join(dir, "file.txt"), []byte("main"), 0o644)
+	os.WriteFile(filepath.Join(dir, "both.txt"), []byte("main"), 0o644)
+	runGit(t, dir, "add", ".")
+	runGit(t, dir, "commit", "-m", "main")
+
+	_ = exec.Command("git", "-C", dir, "merge", "other").Run()
+
+	d, err := gitDiff(dir)
+	if err != nil {
+		t.Fatalf("gitDiff: %v", err)
+	}
+
+	// UU file.txt and AA both.txt
+	if d.conflicted != 2 {
+		t.Errorf("expected 2 conflicted files, got %+v", d)
+	}
+	if d.added != 0 || d.modified != 0 || d.deleted != 0 {
+		t.Errorf("expected conflicts not to count as changes, got %+v", d)
+	}
+
+	row := rowItem{path: dir, changes: d, changedFiles: d.String()}
+	if !row.isConflicted() || !row.isDirty() {
+		t.Error("expected row to be conflicted and dirty")
+	}
+}
+
+func TestSortRowsConflictsFirst(t *testing.T) {
+
+	rows := []rowItem{
+		{path: "/work/a"},
+		{path: "/work/c", changes: diffCounts{conflicted: 1}},
+		{path: "/work/b"},
+	}
+
+	sortRows(rows)
+
+	var got []string
+	for _, r := range rows {
+		got = append(got, r.path)
+	}
+
+	want := []string{"/work/c", "/work/a", "/work/b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestParseRemote(t *testing.T) {
+
+	tests := []struct {
+		remote string
+		host   string
+		owner  string
+	}{
+		{"git@github.com:Jleagle/gitstatus.git", "github.com", "Jleagle"},
+		{"https://github.com/Jleagle/gitstatus.git", "github.com", "Jleagle"},
+		{"https://user@GitLab.com/group/sub/repo", "gitlab.com", "group/sub"},
+		{"ssh://git@example.com:2222/owner/repo.git", "example.com", "owner"},
+		{"/srv/git/repo.git", "", ""},
+		{"file:///srv/git/repo.git", "", ""},
+		{"", "", ""},
+	}
+
+	for _, tt := range tests {
+		host, owner := parseRemote(tt.remote)
+		if host != tt.host || owner != tt.owner {
+			t.Errorf("parseRemote(%q) = %q, %q, expected %q, %q", tt.remote, host, owner, tt.host, tt.owner)
+		}
+	}
+}
+
+func TestGitLastCommitAndRemote(t *testing.T) {
+
+	dir := initTestRepo(t)
+
+	last, err := gitLastCommit(dir)
+	if err != nil {
+		t.Fatalf("gitLastCommit: %v", err)
+	}
+	if time.Since(last.when) > time.Minute || len(last.hash) < 7 || last.author != "Test" || last.subject != "initial" {
+		t.Errorf("expected the initial commit, got %+v", last)
+	}
+
+	remote, err := gitRemoteURL(dir)
+	if err != nil || remote != "" {
+		t.Errorf("expected no remote, got %q, %v", remote, err)
+	}
+
+	runGit(t, dir, "remote", "add", "origin", "git@github.com:owner/repo.git")
+
+	remote, err = gitRemoteURL(dir)
+	if err != nil || remote != "git@github.com:owner/repo.git" {
+		t.Errorf("expected the origin url, got %q, %v", remote, err)
+	}
+
+	empty := t.TempDir()
+	runGit(t, empty, "init")
+
+	last, err = gitLastCommit(empty)
+	if err != nil || last != (commitInfo{}) {
+		t.Errorf("expected no commit, got %+v, %v", last, err)
+	}
+}
+
+func TestSortRowsBy(t *testing.T) {
+
+	t.Cleanup(func() { viper.Reset() })
+
+	now := time.Now()
+	rows := []rowItem{
+		{path: "/work/a", branch: "zed", behind: 1, lastCommit: commitInfo{when: now.Add(-time.Hour)}},
+		{path: "/work/b", branch: "alpha", behind: 3, lastCommit: commitInfo{when: now}, error: errors.New("boom")},
+		{path: "/work/c", branch: "main", behind: 3, lastCommit: commitInfo{when: now.Add(-2 * time.Hour)}},
+	}
+
+	tests := []struct {
+		sort    string
+		reverse bool
+		want    []string
+	}{
+		{"path", false, []string{"/work/a", "/work/b", "/work/c"}},
+		{"path", true, []string{"/work/c", "/work/b", "/work/a"}},
+		{"branch", false, []string{"/work/b", "/work/c", "/work/a"}},
+		{"behind", false, []string{"/work/b", "/work/c", "/work/a"}},
+		{"behind", true, []string{"/work/a", "/work/c", "/work/b"}},
+		{"last-commit", false, []string{"/work/b", "/work/a", "/work/c"}},
+		{"error", false, []string{"/work/b", "/work/a", "/work/c"}},
+	}
+
+	for _, tt := range tests {
+
+		viper.Set(fSort, tt.sort)
+		viper.Set(fReverse, tt.reverse)
+
+		sortRows(rows)
+
+		var got []string
+		for _, r := range rows {
+			got = append(got, r.path)
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sort %s reverse %v: expected %v, got %v", tt.sort, tt.reverse, tt.want, got)
+		}
+	}
+}
+
+func TestGroupRows(t *testing.T) {
+
+	t.Cleanup(func() { viper.Reset() })
+	viper.Set(fGroupBy, "owner")
+
+	rows := []rowItem{
+		{path: "/work/a", remote: "git@github.com:zeta/a.git"},
+		{path: "/work/b", remote: "git@github.com:alpha/b.git"},
+		{path: "/work/c"},
+		{path: "/work/d", remote: "https://gitlab.com/alpha/d"},
+	}
+
+	sections := groupRows(rows, []string{"/work"})
+
+	var got []string
+	for i, r := range rows {
+		got = append(got, sections[i]+" "+r.path)
+	}
+
+	want := []string{"alpha /work/b", "alpha /work/d", "no owner /work/c", "zeta /work/a"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestTableColumnNames(t *testing.T) {
+
+	t.Cleanup(func() { viper.Reset() })
+
+	rows := []rowItem{{path: "/work/a", stashes: 1}}
+
+	want := []string{"repo", "branch", "changes", "sync", "state"}
+	if got := tableColumnNames(rows); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected default columns %v, got %v", want, got)
+	}
+
+	viper.Set(fColumns, []string{"repo,ahead", "remote"})
+
+	want = []string{"repo", "ahead", "remote"}
+	if got := tableColumnNames(rows); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected picked columns %v, got %v", want, got)
+	}
+	if err := checkColumns(); err != nil {
+		t.Errorf("expected known columns, got %v", err)
+	}
+
+	viper.Set(fColumns, []string{"repo,nope"})
+	if err := checkColumns(); err == nil || !strings.Contains(err.Error(), "nope") {
+		t.Errorf("expected an unknown column error, got %v", err)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+
+	tmpl, err := parseFormat(`{{.Path}} {{.Branch}} {{if gt .Behind 0}}behind {{.Behind}}{{end}}`)
+	if err != nil {
+		t.Fatalf("parseFormat: %v", err)
+	}
+
+	var b strings.Builder
+	for _, row := range []rowItem{{path: "/work/a", branch: "main", behind: 2}, {path: "/work/b", branch: "dev"}} {
+		if err := tmpl.Execute(&b, row.view()); err != nil {
+			t.Fatalf("Execute: %v", err)
+		}
+	}
+
+	want := "/work/a main behind 2\n/work/b dev \n"
+	if b.String() != want {
+		t.Errorf("expected %q, got %q", want, b.String())
+	}
+
+	if _, err := parseFormat("{{.Path"); err == nil {
+		t.Error("expected an error for a bad template")
+	}
+}
+
+func TestExecExitCode(t *testing.T) {
+
+	if got := execExitCode([]execItem{{path: "/work/a"}, {path: "/work/b"}}); got != exitClean {
+		t.Errorf("expected %d when every command passed, got %d", exitClean, got)
+	}
+	if got := execExitCode([]execItem{{path: "/work/a"}, {path: "/work/b", exitCode: 1}}); got != exitErrored {
+		t.Errorf("expected %d when a command failed, got %d", exitErrored, got)
+	}
+	if got := execExitCode([]execItem{{path: "/work/a", error: errors.New("not found")}}); got != exitErrored {
+		t.Errorf("expected %d when a command could not run, got %d", exitErrored, got)
+	}
+}
+
+func TestRowsExitCode(t *testing.T) {
+
+	t.Cleanup(func() { viper.Reset() })
+
+	clean := rowItem{path: "/work/a", branch: "main"}
+	pulled := rowItem{path: "/work/b", branch: "main", updated: true, behind: 2}
+	dirty := rowItem{path: "/work/c", branch: "main", changedFiles: "~1"}
+	failed := rowItem{path: "/work/d", branch: "main", error: errors.New("boom")}
+
+	tests := []struct {
+		name   string
+		failOn []string
+		rows   []rowItem
+		want   int
+	}{
+		{"clean", nil, []rowItem{clean, pulled}, exitClean},
+		{"dirty", nil, []rowItem{clean, dirty}, exitAttention},
+		{"errored", nil, []rowItem{dirty, failed}, exitErrored},
+		{"fail on behind", []string{"behind"}, []rowItem{clean, pulled}, exitAttention},
+		{"fail on behind ignores dirty", []string{"behind"}, []rowItem{clean, dirty}, exitClean},
+		{"fail on error", []string{"dirty,error"}, []rowItem{dirty, failed}, exitErrored},
+		{"not failing on error", []string{"off-main"}, []rowItem{failed}, exitClean},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set(fFailOn, tt.failOn)
+			if got := rowsExitCode(tt.rows); got != tt.want {
+				t.Errorf("expected exit code %d, got %d", tt.want, got)
+			}
+		})
+	}
+
+	viper.Set(fFailOn, []string{"dirty,stale"})
+	if err := checkStates(); err == nil || !strings.Contains(err.Error(), "--fail-on") {
+		t.Errorf("expected an unknown state error, got %v", err)
+	}
+}
+
+func TestParseAge(t *testing.T) {
+
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"30d", 30 * 24 * time.Hour, false},
+		{"2w", 14 * 24 * time.Hour, false},
+		{"36h", 36 * time.Hour, false},
+		{"xd", 0, true},
+		{"soon", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseAge(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseAge(%q) = %v, %v, expected %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestRelativeAge(t *testing.T) {
+
+	now := time.Now()
+
+	tests := map[time.Duration]string{
+		10 * time.Second:       "just now",
+		time.Minute:            "1 minute ago",
+		5 * time.Hour:          "5 hours ago",
+		3 * 7 * 24 * time.Hour: "3 weeks ago",
+		400 * 24 * time.Hour:   "1 year ago",
+	}
+
+	for ago, want := range tests {
+		if got := relativeAge(now.Add(-ago)); got != want {
+			t.Errorf("relativeAge(-%v) = %q, expected %q", ago, got, want)
+		}
+	}
+}
+
+func TestShowStale(t *testing.T) {
+
+	t.Cleanup(func() { viper.Reset() })
+	viper.Set(fStale, "30d")
+
+	old := time.Now().Add(-60 * 24 * time.Hour)
+	recent := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name string
+		row  rowItem
+		want bool
+	}{
+		{"old commit, never fetched", rowItem{branch: "main", lastCommit: commitInfo{when: old}}, true},
+		{"old commit, recent fetch", rowItem{branch: "main", lastCommit: commitInfo{when: old}, lastFetch: recent}, false},
+		{"recent commit, dirty", rowItem{branch: "main", changedFiles: "~1", lastCommit: commitInfo{when: recent}}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.row.show(); got != tt.want {
+			t.Errorf("%s: expected show() = %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestMatchesStateFilters(t *testing.T) {
+
+	t.Cleanup(func() { viper.Reset() })
+
+	clean := rowItem{branch: "main"}
+	dirty := rowItem{branch: "main", changedFiles: "~1"}
+
+	// Hidden from the table, but still in machine-readable output
+	if clean.show() || !clean.matchesStateFilters() {
+		t.Error("expected a clean row to be hidden from the table but kept for JSON")
+	}
+
+	viper.Set(fHide, []string{"dirty"})
+	if dirty.matchesStateFilters() || !clean.matchesStateFilters() {
+		t.Error("expected --hide to apply to JSON rows")
+	}
+}
+
+func TestShowOnlyAndHide(t *testing.T) {
+
+	rows := map[string]rowItem{
+		"clean":  {branch: "main"},
+		"behind": {branch: "main", behind: 1},
+		"dirty":  {branch: "main", changedFiles: "~1"},
+		"ahead":  {branch: "feature", ahead: 2},
+		"failed": {branch: "main", error: errors.New("boom")},
+	}
+
+	tests := []struct {
+		name string
+		only []string
+		hide []string
+		want []string
+	}{
+		{"default", nil, nil, []string{"ahead", "dirty", "failed"}},
+		{"only behind shows rows that are otherwise hidden", []string{"behind"}, nil, []string{"behind"}},
+		{"only is combinable", []string{"dirty,ahead"}, nil, []string{"ahead", "dirty"}},
+		{"hide", nil, []string{"error", "off-main"}, []string{"dirty"}},
+		{"only and hide", []string{"dirty", "ahead"}, []string{"off-main"}, []string{"dirty"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			t.Cleanup(func() { viper.Reset() })
+			viper.Set(fOnly, tt.only)
+			viper.Set(fHide, tt.hide)
+
+			var got []string
+			for name, row := range rows {
+				if row.show() {
+					got = append(got, name)
+				}
+			}
+			slices.Sort(got)
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTrimRoot(t *testing.T) {
+
+	roots := []string{"/home/me/code", "/home/me/code/work", "/home/me/go/src"}
+
+	tests := map[string]string{
+		"/home/me/code/foo":         "/foo",
+		"/home/me/code/work/bar":    "/bar",
+		"/home/me/go/src/x.com/baz": "/x.com/baz",
+		"/home/me/code-old/qux":     "/home/me/code-old/qux",
+		"/home/me/code":             "",
+	}
+
+	for path, want := range tests {
+		if got := trimRoot(path, roots); got != want {
+			t.Errorf("trimRoot(%q) = %q, expected %q", path, got, want)
+		}
+	}
+}
+
+func TestFindReposMultipleRoots(t *testing.T) {
+
+	t.Cleanup(func() { viper.Reset() })
+
+	base := t.TempDir()
+	code := filepath.Join(base, "code")
+	work := filepath.Join(base, "work")
+	link := filepath.Join(base, "link")
+
+	for _, dir := range []string{filepath.Join(code, "a"), filepath.Join(code, "nested", "b"), filepath.Join(work, "c")} {
+		if err := os.MkdirAll(filepath.Join(dir, ".git"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(code, link); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overlapping and symlinked roots, with one given as a comma separated list
+	viper.Set(fMaxdepth, 2)
+	viper.Set(fDir, []string{code, work + "," + filepath.Join(code, "nested"), link})
+
+	repos, roots, ok := findRepos()
+	if !ok {
+		t.Fatal("expected repos to be found")
+	}
+	if len(roots) != 4 {
+		t.Errorf("expected 4 roots, got %v", roots)
+	}
+
+	var got []string
+	for _, r := range repos {
+		got = append(got, trimRoot(r.path, roots))
+	}
+	slices.Sort(got)
+
+	want := []string{"/a", "/b", "/c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestStreamRepos(t *testing.T) {
+
+	t.Cleanup(func() { viper.Reset() })
+
+	base := t.TempDir()
+	for _, name := range []string{"api", "api-v2", "web", filepath.Join("group", "api-old")} {
+		if err := os.MkdirAll(filepath.Join(base, name, ".git"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	viper.Set(fMaxdepth, 2)
+	viper.Set(fFilter, "api")
+
+	// The same root twice should not find anything twice
+	var total int
+	var mu sync.Mutex
+	var got []string
+	poolRepoStream(streamRepos([]string{base, base}, &total), func(r repoItem) {
+		mu.Lock()
+		got = append(got, strings.TrimPrefix(r.path, base))
+		mu.Unlock()
+	})
+	slices.Sort(got)
+
+	want := []string{"/api", "/api-v2", "/group/api-old"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if total != 4 {
+		t.Errorf("expected 4 repos found before filtering, got %d", total)
+	}
+}
+
+func TestStreamReposPrefersFirstRoot(t *testing.T) {
+
+	t.Cleanup(func() { viper.Reset() })
+
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := filepath.Join(base, "code")
+	work := filepath.Join(base, "work") // A link to code/work
+	if err := os.MkdirAll(filepath.Join(code, "work", "x", ".git"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(code, "work"), work); err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Set(fMaxdepth, 2)
+
+	// Whichever walk finds the repo first, it is shown through the first root listed
+	for roots, want := range map[[2]string]string{
+		{code, work}: filepath.Join(code, "work", "x"),
+		{work, code}: filepath.Join(work, "x"),
+	} {
+		for range 20 {
+			var total int
+			var got []string
+			for r := range streamRepos(roots[:], &total) {
+				got = append(got, r.path)
+			}
+			if !reflect.DeepEqual(got, []string{want}) {
+				t.Fatalf("roots %v: expected [%s], got %v", roots, want, got)
+			}
+		}
+	}
+
+	if got := preferredPath("/elsewhere/x", "/elsewhere/x", []string{"/code"}, []string{"/code"}); got != "/elsewhere/x" {
+		t.Errorf("expected a path outside every root to be kept, got %s", got)
+	}
+}
@@ -1,29 +1,418 @@
 package main
 
 import (
+	"cmp"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
 	"github.com/spf13/viper"
 )
 
+type diffCounts struct {
+	added      int
+	modified   int
+	deleted    int
+	staged     int
+	unstaged   int
+	untracked  int
+	renamed    int
+	conflicted int
+}
+
+// String returns a colored summary of new/changed/deleted/conflicted files, new includes untracked files
+func (d diffCounts) String() string {
+
+	var parts []string
+	if d.added+d.untracked > 0 {
+		parts = append(parts, color.GreenString("+%d", d.added+d.untracked))
+	}
+	if d.modified > 0 {
+		parts = append(parts, color.RGB(255, 165, 0).Sprintf("~%d", d.modified))
+	}
+	if d.deleted > 0 {
+		parts = append(parts, color.RedString("-%d", d.deleted))
+	}
+	if d.conflicted > 0 {
+		parts = append(parts, color.New(color.FgRed, color.Bold).Sprintf("!%d", d.conflicted))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// total is the number of files in the changes column
+func (d diffCounts) total() int {
+	return d.added + d.untracked + d.modified + d.deleted + d.conflicted
+}
+
 type rowItem struct {
-	path         string //
-	branch       string //
-	changedFiles string // Modified files
-	updated      bool   // If something was pulled down
-	error        error  //
+	path          string     //
+	worktreeOf    string     // Main repo path, for linked worktrees
+	branch        string     //
+	mainBranches  []string   // Branch names that count as main
+	defaultBranch string     // Detected from origin/HEAD, overrides mainBranches
+	changedFiles  string     // Modified files
+	changes       diffCounts // Counts of modified files
+	operation     string     // Rebase, merge etc in progress
+	stashes       int        // Number of stash entries
+	updated       bool       // If something was pulled down
+	stashConflict bool       // Re-applying an autostash conflicted
+	fetched       int        // New upstream commits from a fetch
+	pruned        []string   // Remote branches pruned by a fetch
+	ahead         int        // Commits not pushed to upstream
+	behind        int        // Commits not pulled from upstream
+	lastCommit    commitInfo // The commit at HEAD
+	lastFetch     time.Time  // When FETCH_HEAD was written
+	remote        string     // Origin URL
+	error         error      //
 }
 
 func (r rowItem) show() bool {
-	return viper.GetBool(fAll) || !r.isMain() || r.isDirty() || r.updated || (r.error != nil)
+
+	if !r.matchesStateFilters() {
+		return false
+	}
+
+	// Asking for repos in a state shows them whether or not they have anything else to report
+	age, _ := parseAge(viper.GetString(fStale))
+	if len(splitList(viper.GetStringSlice(fOnly))) > 0 || age > 0 {
+		return true
+	}
+
+	return viper.GetBool(fAll) || r.needsAttention() || r.updated || r.fetched > 0 || len(r.pruned) > 0
+}
+
+// matchesStateFilters is true if the row is not picked out by --only, --hide or --stale, ignoring whether it has
+// anything to report
+func (r rowItem) matchesStateFilters() bool {
+
+	if r.inAnyState(splitList(viper.GetStringSlice(fHide))) {
+		return false
+	}
+
+	only := splitList(viper.GetStringSlice(fOnly))
+	age, _ := parseAge(viper.GetString(fStale))
+
+	return (len(only) == 0 || r.inAnyState(only)) && (age == 0 || r.isStale(age))
+}
+
+// needsAttention is true if the repo is in a state someone should act on, rather than just having news from a pull or fetch
+func (r rowItem) needsAttention() bool {
+	return !r.isMain() || r.isDirty() || r.operation != "" || r.stashes > 0 || r.stashConflict || r.ahead > 0 || (r.error != nil)
+}
+
+// filteringByState is true if any of --only, --hide or --stale are picking which rows are shown
+func filteringByState() bool {
+	age, _ := parseAge(viper.GetString(fStale))
+	return len(splitList(viper.GetStringSlice(fOnly))) > 0 || age > 0 || len(splitList(viper.GetStringSlice(fHide))) > 0
+}
+
+// rowStates are the states that --only, --hide and --fail-on pick rows by
+var rowStates = map[string]func(r rowItem) bool{
+	"dirty":    rowItem.isDirty,
+	"ahead":    func(r rowItem) bool { return r.ahead > 0 },
+	"behind":   func(r rowItem) bool { return r.behind > 0 },
+	"off-main": func(r rowItem) bool { return !r.isMain() },
+	"detached": rowItem.isDetached,
+	"error":    func(r rowItem) bool { return r.error != nil },
+	"updated":  func(r rowItem) bool { return r.updated },
+}
+
+// inAnyState is true if the row is in at least one of the named states
+func (r rowItem) inAnyState(names []string) bool {
+	for _, name := range names {
+		if is, ok := rowStates[name]; ok && is(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// group returns the path rows are grouped under, so worktrees sit with their main repo
+func (r rowItem) group() string {
+	if r.worktreeOf != "" {
+		return r.worktreeOf
+	}
+	return r.path
 }
 
 func (r rowItem) isMain() bool {
-	return r.branch == "master" || r.branch == "main" || r.branch == "trunk" || r.branch == "develop" || r.branch == "dev"
+
+	if r.defaultBranch != "" {
+		return r.branch == r.defaultBranch
+	}
+
+	if len(r.mainBranches) > 0 {
+		return slices.Contains(r.mainBranches, r.branch)
+	}
+
+	return slices.Contains(defaultMainBranches, r.branch)
 }
 
 func (r rowItem) isDetached() bool {
 	return len(r.branch) == 40 // Git commit hash length
 }
 
+// isStale is true if there has been no local commit or fetch for the given age
+func (r rowItem) isStale(age time.Duration) bool {
+
+	last := r.lastCommit.when
+	if r.lastFetch.After(last) {
+		last = r.lastFetch
+	}
+
+	return time.Since(last) > age
+}
+
+func (r rowItem) isConflicted() bool {
+	return r.changes.conflicted > 0
+}
+
 func (r rowItem) isDirty() bool {
 	return r.changedFiles != ""
 }
+
+func (r rowItem) displayPath(roots []string) string {
+
+	path := r.path
+	if viper.GetBool(fShort) {
+		path = trimRoot(path, roots)
+	}
+	if r.worktreeOf != "" {
+		path = "↳ " + path
+	}
+
+	return path
+}
+
+func (r rowItem) displayBranch() string {
+
+	branch := r.branch
+	if r.isDetached() {
+		branch = fmt.Sprintf("(detached at %s)", branch[:7])
+	} else if len(branch) > 30 {
+		branch = branch[:30] + "…"
+	}
+
+	if !r.isMain() {
+		branch = color.RedString(branch)
+	}
+
+	return branch
+}
+
+func (r rowItem) sync() string {
+
+	var parts []string
+	if r.ahead > 0 {
+		parts = append(parts, fmt.Sprintf("↑%d", r.ahead))
+	}
+	if r.behind > 0 {
+		parts = append(parts, fmt.Sprintf("↓%d", r.behind))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func (r rowItem) state() string {
+
+	var parts []string
+	if r.isConflicted() {
+		parts = append(parts, color.New(color.FgRed, color.Bold).Sprint("CONFLICT"))
+	}
+	if r.operation != "" {
+		parts = append(parts, color.RedString(r.operation))
+	}
+	if r.stashConflict {
+		parts = append(parts, color.RedString("STASH CONFLICT"))
+	}
+	if r.stashes > 0 {
+		parts = append(parts, fmt.Sprintf("stash:%d", r.stashes))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func (r rowItem) fetch() string {
+
+	var parts []string
+	if r.fetched > 0 {
+		parts = append(parts, fmt.Sprintf("%d new", r.fetched))
+	}
+	if len(r.pruned) > 0 {
+		parts = append(parts, "pruned "+strings.Join(r.pruned, ", "))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// pull describes what pulling did, blank when not pulling
+func (r rowItem) pull() string {
+
+	if !viper.GetBool(fPull) {
+		return ""
+	}
+
+	if r.updated {
+		return color.GreenString("Updated")
+	} else if !r.isDirty() || viper.GetBool(fAutostash) {
+		return "Pulled"
+	}
+
+	return ""
+}
+
+func (r rowItem) lastCommitDate() string {
+	if r.lastCommit.when.IsZero() {
+		return ""
+	}
+	return r.lastCommit.when.Format("2006-01-02 15:04")
+}
+
+func (r rowItem) lastCommitAge() string {
+	if r.lastCommit.when.IsZero() {
+		return ""
+	}
+	return relativeAge(r.lastCommit.when)
+}
+
+// lastCommitSubject is cut short to keep the table narrow
+func (r rowItem) lastCommitSubject() string {
+	if len([]rune(r.lastCommit.subject)) > 50 {
+		return string([]rune(r.lastCommit.subject)[:50]) + "…"
+	}
+	return r.lastCommit.subject
+}
+
+// rowView is the exported form of a row, used for machine-readable output and --format templates
+type rowView struct {
+	Path          string    `json:"path"`
+	WorktreeOf    string    `json:"worktree_of,omitempty"`
+	Branch        string    `json:"branch"`
+	Added         int       `json:"added"`
+	Modified      int       `json:"modified"`
+	Deleted       int       `json:"deleted"`
+	Staged        int       `json:"staged"`
+	Unstaged      int       `json:"unstaged"`
+	Untracked     int       `json:"untracked"`
+	Renamed       int       `json:"renamed"`
+	Conflicted    int       `json:"conflicted"`
+	Operation     string    `json:"operation,omitempty"`
+	Stashes       int       `json:"stashes"`
+	Ahead         int       `json:"ahead"`
+	Behind        int       `json:"behind"`
+	LastCommit    time.Time `json:"last_commit,omitzero"`
+	CommitHash    string    `json:"commit_hash,omitempty"`
+	CommitAuthor  string    `json:"commit_author,omitempty"`
+	CommitSubject string    `json:"commit_subject,omitempty"`
+	LastFetch     time.Time `json:"last_fetch,omitzero"`
+	Remote        string    `json:"remote,omitempty"`
+	Updated       bool      `json:"updated"`
+	StashConflict bool      `json:"stash_conflict"`
+	Fetched       int       `json:"fetched"`
+	Pruned        []string  `json:"pruned,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+func (r rowItem) view() rowView {
+
+	v := rowView{
+		Path:          r.path,
+		WorktreeOf:    r.worktreeOf,
+		Branch:        r.branch,
+		Added:         r.changes.added,
+		Modified:      r.changes.modified,
+		Deleted:       r.changes.deleted,
+		Staged:        r.changes.staged,
+		Unstaged:      r.changes.unstaged,
+		Untracked:     r.changes.untracked,
+		Renamed:       r.changes.renamed,
+		Conflicted:    r.changes.conflicted,
+		Operation:     r.operation,
+		Stashes:       r.stashes,
+		Ahead:         r.ahead,
+		Behind:        r.behind,
+		LastCommit:    r.lastCommit.when,
+		CommitHash:    r.lastCommit.hash,
+		CommitAuthor:  r.lastCommit.author,
+		CommitSubject: r.lastCommit.subject,
+		LastFetch:     r.lastFetch,
+		Remote:        r.remote,
+		Updated:       r.updated,
+		StashConflict: r.stashConflict,
+		Fetched:       r.fetched,
+		Pruned:        r.pruned,
+	}
+
+	if r.error != nil {
+		v.Error = r.error.Error()
+	}
+
+	return v
+}
+
+// rowSorts compares rows for each --sort value, counts sort highest first and dates newest first.
+// A nil func sorts by path.
+var rowSorts = map[string]func(a, b rowItem) int{
+	"":     nil,
+	"path": nil,
+	"branch": func(a, b rowItem) int {
+		return strings.Compare(strings.ToLower(a.branch), strings.ToLower(b.branch))
+	},
+	"changes": func(a, b rowItem) int {
+		return cmp.Compare(b.changes.total(), a.changes.total())
+	},
+	"behind": func(a, b rowItem) int {
+		return cmp.Compare(b.behind, a.behind)
+	},
+	"ahead": func(a, b rowItem) int {
+		return cmp.Compare(b.ahead, a.ahead)
+	},
+	"last-commit": func(a, b rowItem) int {
+		return b.lastCommit.when.Compare(a.lastCommit.when)
+	},
+	"error": func(a, b rowItem) int {
+		if (a.error != nil) != (b.error != nil) {
+			if a.error != nil {
+				return -1
+			}
+			return 1
+		}
+		if a.error != nil {
+			return strings.Compare(a.error.Error(), b.error.Error())
+		}
+		return 0
+	},
+}
+
+// rowGroups returns the table section a row belongs in for each --group-by value
+var rowGroups = map[string]func(r rowItem, roots []string) string{
+	"": nil,
+	"parent": func(r rowItem, roots []string) string {
+		parent := filepath.Dir(r.group()) // Keep worktrees with their main repo
+		if viper.GetBool(fShort) {
+			parent = trimRoot(parent, roots)
+		}
+		if parent == "" {
+			return string(filepath.Separator)
+		}
+		return parent
+	},
+	"remote-host": func(r rowItem, roots []string) string {
+		host, _ := parseRemote(r.remote)
+		return cmp.Or(host, "no remote")
+	},
+	"owner": func(r rowItem, roots []string) string {
+		_, owner := parseRemote(r.remote)
+		return cmp.Or(owner, "no owner")
+	},
+	"branch": func(r rowItem, roots []string) string {
+		if r.isDetached() {
+			return "detached"
+		}
+		return cmp.Or(r.branch, "no branch")
+	},
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/viper"
+)
+
+// snapshot is every row from the last run, keyed by repo path
+type snapshot map[string]rowView
+
+func snapshotPath() (string, error) {
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "gitstatus", "snapshot.json"), nil
+}
+
+func loadSnapshot(path string) (snapshot, error) {
+
+	snap := snapshot{}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return snap, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return snap, json.Unmarshal(b, &snap)
+}
+
+func (s snapshot) save(path string) error {
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, b, 0o644)
+}
+
+// update returns a new snapshot with this run's rows, and repos that were expected but not found removed
+func (s snapshot) update(rows []rowItem, gone []string) snapshot {
+
+	next := snapshot{}
+	for path, v := range s {
+		next[path] = v
+	}
+	for _, path := range gone {
+		delete(next, path)
+	}
+	for _, row := range rows {
+		next[row.path] = row.view()
+	}
+
+	return next
+}
+
+// goneRepos returns repos from the snapshot that are under a root dir and match the filter, but were not found this run
+func (s snapshot) goneRepos(rows []rowItem, roots []string) (gone []string) {
+
+	found := map[string]bool{}
+	for _, row := range rows {
+		found[row.path] = true
+	}
+
+	var candidates []repoItem
+	for path := range s {
+		if !found[path] && trimRoot(path, roots) != path {
+			candidates = append(candidates, repoItem{path: path})
+		}
+	}
+
+	for _, r := range filterReposByFilterFlag(candidates) {
+		gone = append(gone, r.path)
+	}
+
+	return gone
+}
+
+// fieldChange is a before and after value
+type fieldChange struct {
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// rowChange is how a repo has changed since the last snapshot
+type rowChange struct {
+	Path   string                 `json:"path"`
+	Status string                 `json:"status,omitempty"` // new or gone
+	Fields map[string]fieldChange `json:"fields,omitempty"`
+}
+
+var changeFields = []string{"branch", "changes", "sync", "error"}
+
+// changeValues returns the compared values of a row, formatted as they are in the table
+func changeValues(v rowView) map[string]string {
+	return map[string]string{
+		"branch":  v.Branch,
+		"changes": diffCounts{added: v.Added, untracked: v.Untracked, modified: v.Modified, deleted: v.Deleted, conflicted: v.Conflicted}.String(),
+		"sync":    rowItem{ahead: v.Ahead, behind: v.Behind}.sync(),
+		"error":   v.Error,
+	}
+}
+
+// diff compares this run's rows against the last snapshot
+func (s snapshot) diff(rows []rowItem, gone []string) (changes []rowChange) {
+
+	for _, row := range rows {
+
+		before, ok := s[row.path]
+		if !ok {
+			changes = append(changes, rowChange{Path: row.path, Status: "new"})
+			continue
+		}
+
+		b, a := changeValues(before), changeValues(row.view())
+
+		fields := map[string]fieldChange{}
+		for _, field := range changeFields {
+			if b[field] != a[field] {
+				fields[field] = fieldChange{Before: b[field], After: a[field]}
+			}
+		}
+
+		if len(fields) > 0 {
+			changes = append(changes, rowChange{Path: row.path, Fields: fields})
+		}
+	}
+
+	for _, path := range gone {
+		changes = append(changes, rowChange{Path: path, Status: "gone"})
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return strings.ToLower(changes[i].Path) < strings.ToLower(changes[j].Path)
+	})
+
+	return changes
+}
+
+func outputChanges(changes []rowChange, roots []string) {
+
+	if len(changes) == 0 {
+		log.Println(color.BlueString("Nothing has changed since the last run"))
+		return
+	}
+
+	tab := table.NewWriter()
+	tab.SetOutputMirror(os.Stdout)
+	tab.AppendHeader(table.Row{"Repo", "Branch", "Changes", "Sync", "Error"})
+	tab.SetStyle(table.StyleRounded)
+
+	for _, change := range changes {
+
+		path := change.Path
+		if viper.GetBool(fShort) {
+			path = trimRoot(path, roots)
+		}
+
+		switch change.Status {
+		case "new":
+			tab.AppendRow(table.Row{path, color.GreenString("new repo")})
+			continue
+		case "gone":
+			tab.AppendRow(table.Row{path, color.RedString("repo gone")})
+			continue
+		}
+
+		tr := table.Row{path}
+		for _, field := range changeFields {
+			if fc, ok := change.Fields[field]; ok {
+				tr = append(tr, orDash(fc.Before)+" → "+orDash(fc.After))
+			} else {
+				tr = append(tr, "")
+			}
+		}
+
+		tab.AppendRow(tr)
+	}
+
+	tab.Render()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
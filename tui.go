@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+const (
+	ansiAltScreen  = "\x1b[?1049h\x1b[?25l" // Switch to the alternate screen and hide the cursor
+	ansiMainScreen = "\x1b[?25h\x1b[?1049l" // Show the cursor and switch back
+	ansiClear      = "\x1b[H\x1b[2J"
+)
+
+var tuiCmd = &cobra.Command{
+	Use:   "tui",
+	Short: "Interactive view with live updating rows and per-repo actions",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if err := loadConfig(); err != nil {
+			log.Println("unable to load config: " + err.Error())
+			exitCode = exitFailed
+			return
+		}
+
+		if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+			log.Println("tui needs an interactive terminal")
+			exitCode = exitFailed
+			return
+		}
+
+		repos, roots, ok := findRepos()
+		if !ok {
+			exitCode = exitFailed
+			return
+		}
+
+		if err := runTUI(repos, roots); err != nil {
+			log.Println(err)
+			exitCode = exitFailed
+		}
+	},
+}
+
+// tuiUpdate is sent back to the UI loop when a repo has been (re)loaded
+type tuiUpdate struct {
+	row     rowItem
+	message string
+}
+
+type tui struct {
+	roots    []string
+	rows     []rowItem
+	loaded   map[string]bool   // Rows that have had their status read at least once
+	busy     map[string]string // Action in progress per repo path
+	selected int
+	message  string
+	updates  chan tuiUpdate
+
+	fd       int
+	oldState *term.State
+	inputMu  sync.Mutex // Held while reading a key, and while the screen is handed to another program
+}
+
+func newTUI(repos []repoItem, roots []string) *tui {
+
+	t := &tui{
+		roots:   roots,
+		loaded:  map[string]bool{},
+		busy:    map[string]string{},
+		updates: make(chan tuiUpdate),
+	}
+
+	for _, r := range repos {
+		t.rows = append(t.rows, rowItem{path: r.path, worktreeOf: r.worktreeOf, mainBranches: mainBranches(r.path)})
+	}
+	sortRows(t.rows)
+
+	return t
+}
+
+func runTUI(repos []repoItem, roots []string) (err error) {
+
+	t := newTUI(repos, roots)
+	t.fd = int(os.Stdin.Fd())
+
+	t.oldState, err = term.MakeRaw(t.fd)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(ansiAltScreen)
+	defer func() {
+		fmt.Print(ansiMainScreen)
+		_ = term.Restore(t.fd, t.oldState)
+	}()
+
+	keys := make(chan string)
+	go t.readKeys(keys)
+
+	// Rows fill in as each worker finishes
+	go poolRepos(repos, func(r repoItem) {
+		t.updates <- tuiUpdate{row: readRepo(r, false, false)}
+	})
+
+	t.render()
+
+	for {
+		select {
+		case key, ok := <-keys:
+			if !ok || t.handleKey(key) {
+				return nil
+			}
+		case u := <-t.updates:
+			t.apply(u)
+		}
+		t.render()
+	}
+}
+
+// readKeys polls stdin so that reading can be paused while another program has the terminal
+func (t *tui) readKeys(keys chan<- string) {
+
+	defer close(keys)
+
+	fds := []unix.PollFd{{Fd: int32(t.fd), Events: unix.POLLIN}}
+	buf := make([]byte, 16)
+
+	for {
+		t.inputMu.Lock()
+
+		n, err := unix.Poll(fds, 100)
+		if err == nil && n > 0 {
+			n, err = os.Stdin.Read(buf)
+		} else {
+			n = 0
+		}
+
+		t.inputMu.Unlock()
+
+		if err != nil && !errors.Is(err, unix.EINTR) {
+			return
+		}
+		if n > 0 {
+			keys <- string(buf[:n])
+		}
+	}
+}
+
+// handleKey acts on a key press, returning true to quit
+func (t *tui) handleKey(key string) bool {
+
+	switch key {
+	case "q", "\x03": // ctrl-c
+		return true
+	case "k", "\x1b[A", "\x1bOA":
+		if t.selected > 0 {
+			t.selected--
+		}
+	case "j", "\x1b[B", "\x1bOB":
+		if t.selected < len(t.rows)-1 {
+			t.selected++
+		}
+	case "p":
+		t.action("pulling", func(row rowItem) (rowItem, string) {
+			updated, err := gitPull(row, viper.GetString(fPullStrategy))
+			row = t.reload(row)
+			row.updated = updated
+			return withError(row, err), "Pulled " + row.path
+		})
+	case "f":
+		t.action("fetching", func(row rowItem) (rowItem, string) {
+			fetched, pruned, err := gitFetch(row.path)
+			row = t.reload(row)
+			row.fetched, row.pruned = fetched, pruned
+			return withError(row, err), "Fetched " + row.path
+		})
+	case "r":
+		t.action("refreshing", func(row rowItem) (rowItem, string) {
+			return t.reload(row), "Refreshed " + row.path
+		})
+	case "c":
+		t.action("checking out", func(row rowItem) (rowItem, string) {
+			branch := defaultBranchOf(row)
+			if branch == "" {
+				return row, "No default branch found for " + row.path
+			}
+			err := gitCheckout(row.path, branch)
+			return withError(t.reload(row), err), "Checked out " + branch + " in " + row.path
+		})
+	case "s":
+		if row, ok := t.current(); ok {
+			t.suspend(func() {
+				c := exec.Command("git", "-C", row.path, "status")
+				c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+				_ = c.Run()
+				fmt.Print("\nPress enter to return")
+				_, _ = bufio.NewReader(os.Stdin).ReadString('\n')
+			})
+		}
+	case "o":
+		if row, ok := t.current(); ok {
+			t.suspend(func() {
+				shell := os.Getenv("SHELL")
+				if shell == "" {
+					shell = "/bin/sh"
+				}
+				c := exec.Command(shell)
+				c.Dir = row.path
+				c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+				_ = c.Run()
+			})
+			t.action("refreshing", func(row rowItem) (rowItem, string) {
+				return t.reload(row), ""
+			})
+		}
+	}
+
+	return false
+}
+
+func (t *tui) current() (rowItem, bool) {
+	if t.selected < 0 || t.selected >= len(t.rows) {
+		return rowItem{}, false
+	}
+	return t.rows[t.selected], true
+}
+
+// action runs fn on the selected repo in the background, unless it is already busy
+func (t *tui) action(name string, fn func(row rowItem) (rowItem, string)) {
+
+	row, ok := t.current()
+	if !ok || !t.loaded[row.path] || t.busy[row.path] != "" {
+		return
+	}
+
+	t.busy[row.path] = name
+	t.message = ""
+
+	go func() {
+		row, message := fn(row)
+		t.updates <- tuiUpdate{row: row, message: message}
+	}()
+}
+
+// reload reads a repo's status again, without pulling or fetching
+func (t *tui) reload(row rowItem) rowItem {
+	return readRepo(repoItem{path: row.path, worktreeOf: row.worktreeOf}, false, false)
+}
+
+func (t *tui) apply(u tuiUpdate) {
+
+	for i := range t.rows {
+		if t.rows[i].path == u.row.path {
+			t.rows[i] = u.row
+			break
+		}
+	}
+
+	t.loaded[u.row.path] = true
+	delete(t.busy, u.row.path)
+
+	if u.message != "" {
+		t.message = u.message
+		if u.row.error != nil {
+			t.message = color.RedString(u.row.error.Error())
+		}
+	}
+}
+
+// suspend hands the terminal to fn, restoring the UI afterwards
+func (t *tui) suspend(fn func()) {
+
+	t.inputMu.Lock()
+	defer t.inputMu.Unlock()
+
+	fmt.Print(ansiMainScreen)
+	_ = term.Restore(t.fd, t.oldState)
+
+	fn()
+
+	if state, err := term.MakeRaw(t.fd); err == nil {
+		t.oldState = state
+	}
+	fmt.Print(ansiAltScreen)
+}
+
+func (t *tui) render() {
+
+	_, height, err := term.GetSize(t.fd)
+	if err != nil || height <= 0 {
+		height = 24
+	}
+
+	// Leave room for the table borders, header, message and help lines
+	visible := max(height-7, 1)
+	start := 0
+	if t.selected >= visible {
+		start = t.selected - visible + 1
+	}
+	end := min(start+visible, len(t.rows))
+
+	tab := table.NewWriter()
+	tab.AppendHeader(table.Row{"", "Repo", "Branch", "Changes", "Sync", "State", "Status"})
+	tab.SetStyle(table.StyleRounded)
+
+	var loaded int
+	for _, row := range t.rows {
+		if t.loaded[row.path] {
+			loaded++
+		}
+	}
+
+	for i := start; i < end; i++ {
+
+		row := t.rows[i]
+
+		cursor := ""
+		if i == t.selected {
+			cursor = "›"
+		}
+
+		if !t.loaded[row.path] {
+			tab.AppendRow(table.Row{cursor, row.displayPath(t.roots), "…"})
+			continue
+		}
+
+		var status string
+		switch {
+		case t.busy[row.path] != "":
+			status = color.YellowString(t.busy[row.path] + "…")
+		case row.error != nil:
+			status = color.RedString(row.error.Error())
+		case row.updated:
+			status = color.GreenString("Updated")
+		default:
+			status = row.fetch()
+		}
+
+		tab.AppendRow(table.Row{cursor, row.displayPath(t.roots), row.displayBranch(), row.changedFiles, row.sync(), row.state(), status})
+	}
+
+	var b strings.Builder
+	b.WriteString(ansiClear)
+	b.WriteString(tab.Render())
+	b.WriteString(fmt.Sprintf("\n%d/%d loaded  %s\n", loaded, len(t.rows), t.message))
+	b.WriteString(color.BlueString("↑/↓ move  p pull  f fetch  r refresh  s status  o shell  c checkout default  q quit"))
+
+	// Raw mode does not return the carriage on a new line
+	fmt.Print(strings.ReplaceAll(b.String(), "\n", "\r\n"))
+}
+
+// defaultBranchOf works out which branch to check out to get a repo back on its default
+func defaultBranchOf(row rowItem) string {
+
+	if row.defaultBranch != "" {
+		return row.defaultBranch
+	}
+
+	if branch, err := gitDefaultBranch(row.path); err == nil && branch != "" {
+		return branch
+	}
+
+	branches := row.mainBranches
+	if len(branches) == 0 {
+		branches = defaultMainBranches
+	}
+	for _, branch := range branches {
+		if gitBranchExists(row.path, branch) {
+			return branch
+		}
+	}
+
+	return ""
+}
+
+func withError(row rowItem, err error) rowItem {
+	if err != nil {
+		row.error = err
+	}
+	return row
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/fsnotify/fsnotify"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Re-evaluate repos when their files change",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if err := loadConfig(); err != nil {
+			log.Println("unable to load config: " + err.Error())
+			exitCode = exitFailed
+			return
+		}
+
+		repos, roots, ok := findRepos()
+		if !ok {
+			exitCode = exitFailed
+			return
+		}
+
+		w, err := newRepoWatcher(repos)
+		if err != nil {
+			log.Println("unable to watch repos: " + err.Error())
+			exitCode = exitFailed
+			return
+		}
+		defer w.watcher.Close()
+
+		rows := map[string]rowItem{}
+		for _, row := range statusRepos(repos) {
+			rows[row.path] = row
+		}
+
+		// The table flags only exist on the root command, so show what needs attention with the watch table
+		var initial []rowItem
+		for _, row := range rows {
+			if row.needsAttention() {
+				initial = append(initial, row)
+			}
+		}
+		if len(initial) > 0 {
+			outputChangedRows(initial, roots)
+		}
+		if hidden := len(rows) - len(initial); hidden > 0 {
+			log.Println(color.BlueString("%d repos with nothing to report", hidden))
+		}
+
+		log.Println(color.BlueString("Watching %d repos, ctrl-c to stop", len(repos)))
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		w.run(ctx, rows, viper.GetDuration(fDebounce), func(changed []rowItem) {
+			log.Println(time.Now().Format("15:04:05"))
+			outputChangedRows(changed, roots)
+		})
+	},
+}
+
+// statusRepos reads every repo without fetching or pulling
+func statusRepos(repos []repoItem) (rows []rowItem) {
+
+	var mu sync.Mutex
+
+	poolRepos(repos, func(r repoItem) {
+		row := readRepo(r, false, false)
+		mu.Lock()
+		rows = append(rows, row)
+		mu.Unlock()
+	})
+
+	return rows
+}
+
+type repoWatcher struct {
+	watcher *fsnotify.Watcher
+	repos   map[string]repoItem // Repo path to repo
+	dirs    map[string]string   // Watched dir to repo path
+	failed  int                 // Dirs that could not be watched
+}
+
+// newRepoWatcher watches each repo's working tree, plus the git dir and refs so commits, checkouts and fetches are seen
+func newRepoWatcher(repos []repoItem) (*repoWatcher, error) {
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &repoWatcher{watcher: watcher, repos: map[string]repoItem{}, dirs: map[string]string{}}
+
+	for _, repo := range repos {
+
+		w.repos[repo.path] = repo
+		w.addTree(repo.path, repo.path)
+
+		gitDir := resolveGitDir(repo.path)
+		common := commonGitDir(gitDir)
+
+		w.add(repo.path, gitDir)
+		w.add(repo.path, common)
+		w.addTree(repo.path, filepath.Join(common, "refs"))
+	}
+
+	if w.failed > 1 {
+		log.Println(color.YellowString("unable to watch %d more directories, changes in them will be missed", w.failed-1))
+	}
+
+	return w, nil
+}
+
+func (w *repoWatcher) add(repoPath string, dir string) {
+	if _, ok := w.dirs[dir]; ok {
+		return
+	}
+	if err := w.watcher.Add(dir); err != nil {
+		// Usually the inotify watch limit, only the first is logged to avoid one line per dir
+		if w.failed == 0 {
+			log.Println(color.YellowString("unable to watch %s: %s, try --exclude for large dirs", dir, err))
+		}
+		w.failed++
+		return
+	}
+	w.dirs[dir] = repoPath
+}
+
+// addTree watches a directory and everything under it, skipping nested repos and excluded dirs
+func (w *repoWatcher) addTree(repoPath string, root string) {
+
+	excludes := w.repos[repoPath].excludes
+
+	_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+
+		if d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
+		// Checked on the root too, as new dirs are added as they are created
+		if path != repoPath && isExcluded(path, excludes) {
+			return filepath.SkipDir
+		}
+
+		if path != root {
+			if _, err := os.Stat(filepath.Join(path, ".git")); err == nil {
+				return filepath.SkipDir
+			}
+		}
+
+		w.add(repoPath, path)
+		return nil
+	})
+}
+
+// repoFor returns the repo a changed path belongs to
+func (w *repoWatcher) repoFor(path string) string {
+
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		if repo, ok := w.dirs[p]; ok {
+			return repo
+		}
+		if p == filepath.Dir(p) {
+			return ""
+		}
+	}
+}
+
+// run waits for file changes, and once they settle, re-reads the affected repos and reports any rows that changed
+func (w *repoWatcher) run(ctx context.Context, rows map[string]rowItem, debounce time.Duration, onChange func(changed []rowItem)) {
+
+	pending := map[string]bool{}
+
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+
+			repo := w.repoFor(event.Name)
+			if repo == "" {
+				continue
+			}
+
+			// New directories need watching too
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					w.addTree(repo, event.Name)
+				}
+			}
+
+			pending[repo] = true
+			timer.Reset(debounce)
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println(err)
+
+		case <-timer.C:
+			var repos []repoItem
+			for path := range pending {
+				repos = append(repos, w.repos[path])
+			}
+			pending = map[string]bool{}
+
+			var changed []rowItem
+			for _, row := range statusRepos(repos) {
+				if !reflect.DeepEqual(rows[row.path].view(), row.view()) {
+					rows[row.path] = row
+					changed = append(changed, row)
+				}
+			}
+
+			if len(changed) > 0 {
+				onChange(changed)
+			}
+		}
+	}
+}
+
+// outputChangedRows shows rows whether or not they have anything to report, so a repo going clean is visible
+func outputChangedRows(rows []rowItem, roots []string) {
+
+	sortRows(rows)
+
+	tab := table.NewWriter()
+	tab.SetOutputMirror(os.Stdout)
+	tab.AppendHeader(table.Row{"Repo", "Branch", "Changes", "Sync", "State", "Error"})
+	tab.SetStyle(table.StyleRounded)
+
+	for _, row := range rows {
+
+		var errStr string
+		if row.error != nil {
+			errStr = row.error.Error()
+		}
+
+		tab.AppendRow(table.Row{row.displayPath(roots), row.displayBranch(), row.changedFiles, row.sync(), row.state(), errStr})
+	}
+
+	tab.Render()
+}